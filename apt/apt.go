@@ -2,28 +2,57 @@ package apt
 
 import (
 	"archive/tar"
-	"bufio"
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/subutai-io/gorjun/config"
 	"github.com/subutai-io/gorjun/db"
 	"github.com/subutai-io/gorjun/download"
+	"github.com/subutai-io/gorjun/storage"
 	"github.com/subutai-io/gorjun/upload"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/mkrautz/goar"
 	"github.com/subutai-io/agent/log"
+	"github.com/ulikunitz/xz"
 )
 
-func readDeb(hash string) (control bytes.Buffer, err error) {
-	file, err := os.Open(config.Storage.Path + hash)
-	log.Check(log.WarnLevel, "Opening deb package", err)
+// decompress wraps archive member reader according to its compression, detected by file extension
+func decompress(name string, r io.Reader) (io.ReadCloser, error) {
+	switch path.Ext(name) {
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".xz":
+		xzr, err := xz.NewReader(r)
+		return ioutil.NopCloser(xzr), err
+	case ".zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case ".tar":
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("Unsupported compression of %s", name)
+}
 
+func readDeb(hash string) (control bytes.Buffer, err error) {
+	file, err := storage.Get(hash)
+	if log.Check(log.WarnLevel, "Opening deb package", err) {
+		return control, err
+	}
 	defer file.Close()
 
 	library := ar.NewReader(file)
@@ -31,182 +60,284 @@ func readDeb(hash string) (control bytes.Buffer, err error) {
 		if err != nil {
 			return control, err
 		}
-		if header.Name == "control.tar.gz" {
-			ungzip, err := gzip.NewReader(library)
+		if name := strings.TrimSuffix(header.Name, "/"); strings.HasPrefix(name, "control.tar") {
+			archive, err := decompress(name, library)
 			if err != nil {
 				return control, err
 			}
 
-			defer ungzip.Close()
+			defer archive.Close()
 
-			tr := tar.NewReader(ungzip)
+			tr := tar.NewReader(archive)
 			for tarHeader, err := tr.Next(); err != io.EOF; tarHeader, err = tr.Next() {
 				if err != nil {
 					return control, err
 				}
-				if tarHeader.Name == "./control" {
+				if strings.TrimPrefix(tarHeader.Name, "./") == "control" {
 					if _, err := io.Copy(&control, tr); err != nil {
 						return control, err
 					}
-					break
+					return control, nil
 				}
 			}
 		}
 	}
-	return
+	return control, fmt.Errorf("Control file not found in package")
 }
 
-func getControl(control bytes.Buffer) map[string]string {
-	d := make(map[string]string)
-	for _, v := range strings.Split(control.String(), "\n") {
-		line := strings.Split(v, ":")
-		if len(line) > 1 {
-			d[line[0]] = strings.TrimPrefix(line[1], " ")
-		}
+// getControl parses control file of binary package
+func getControl(control bytes.Buffer) (map[string]string, error) {
+	list, err := parseControl(&control)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("Empty control file")
 	}
-	return d
+	return list[0].Map(), nil
 }
 
-func getSize(file string) (size string) {
-	f, err := os.Open(file)
-	if !log.Check(log.WarnLevel, "Opening file "+file, err) {
-		stat, _ := f.Stat()
-		f.Close()
-		size = strconv.Itoa(int(stat.Size()))
-	}
-	return size
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.+_-]*$`)
+
+// indexPath returns directory of binary packages index for particular suite, component and architecture
+func indexPath(dist, component, arch string) string {
+	return config.Storage.Path + "dists/" + dist + "/" + component + "/binary-" + arch + "/"
 }
 
-func writePackage(meta map[string]string) {
-	var f *os.File
-	if _, err := os.Stat(config.Storage.Path + "Packages"); os.IsNotExist(err) {
-		f, err = os.Create(config.Storage.Path + "Packages")
-		log.Check(log.WarnLevel, "Creating packages file", err)
-		defer f.Close()
-	} else if err == nil {
-		f, err = os.OpenFile(config.Storage.Path+"Packages", os.O_APPEND|os.O_WRONLY, 0600)
-		log.Check(log.WarnLevel, "Opening packages file", err)
-		defer f.Close()
-	} else {
-		log.Warn(err.Error())
+// sourcePath returns directory of source packages index for particular suite and component
+func sourcePath(dist, component string) string {
+	return config.Storage.Path + "dists/" + dist + "/" + component + "/source/"
+}
+
+// poolPath returns location of package in repository pool, the same way as Debian archive does
+func poolPath(component, source, filename string) string {
+	source = strings.Fields(source + " ")[0]
+	prefix := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		prefix = source[:4]
 	}
+	return "pool/" + component + "/" + prefix + "/" + source + "/" + filename
+}
 
-	for k, v := range meta {
-		_, err := f.WriteString(string(k) + ": " + string(v) + "\n")
-		log.Check(log.WarnLevel, "Appending package data", err)
+// location returns suite and component of apt record, legacy records are placed to default ones
+func location(meta map[string]string) (dist, component string) {
+	if dist = meta["distribution"]; len(dist) == 0 {
+		dist = config.Apt.Distribution
 	}
-	_, err := f.Write([]byte("\n"))
-	log.Check(log.WarnLevel, "Appending endline", err)
+	if component = meta["component"]; len(component) == 0 {
+		component = config.Apt.Component
+	}
+	return dist, component
 }
 
 func Upload(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		_, header, _ := r.FormFile("file")
-		md5, sha256, owner := upload.Handler(w, r)
-		if len(md5) == 0 || len(sha256) == 0 {
+		sums, owner := upload.Handler(w, r)
+		defer upload.Release(owner, sums)
+		if len(sums.Md5) == 0 || len(sums.Sha256) == 0 {
 			return
 		}
+		if strings.HasSuffix(sums.Name, ".dsc") {
+			uploadSource(w, r, sums, owner)
+			return
+		}
+		md5 := sums.Md5
+		var meta map[string]string
 		control, err := readDeb(md5)
+		if err == nil {
+			meta, err = getControl(control)
+		}
 		if err != nil {
 			log.Warn(err.Error())
 			w.WriteHeader(http.StatusUnsupportedMediaType)
 			w.Write([]byte(err.Error()))
-			if db.Delete(owner, "apt", md5) == 0 {
-				os.Remove(config.Storage.Path + md5)
-			}
+			db.DropBlob(sums.Sha256)
+			return
+		}
+		meta["distribution"] = r.FormValue("distribution")
+		meta["component"] = r.FormValue("component")
+		dist, component := location(meta)
+		if !validName.MatchString(dist) || !validName.MatchString(component) ||
+			!validName.MatchString(meta["Package"]) || !validName.MatchString(meta["Architecture"]) {
+			log.Warn("Invalid distribution, component, name or architecture of " + sums.Name)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid distribution, component, package name or architecture"))
+			db.DropBlob(sums.Sha256)
 			return
 		}
-		meta := getControl(control)
-		meta["Filename"] = header.Filename
-		meta["Size"] = getSize(config.Storage.Path + md5)
-		meta["SHA512"] = upload.Hash(config.Storage.Path+md5, "sha512")
-		meta["SHA256"] = upload.Hash(config.Storage.Path+md5, "sha256")
-		meta["SHA1"] = upload.Hash(config.Storage.Path+md5, "sha1")
+		if len(meta["Source"]) == 0 {
+			meta["Source"] = meta["Package"]
+		}
+		meta["distribution"], meta["component"] = dist, component
+		meta["Filename"] = poolPath(component, meta["Source"], sums.Name)
+		meta["Size"] = strconv.FormatInt(sums.Size, 10)
+		meta["SHA512"] = sums.Sha512
+		meta["SHA256"] = sums.Sha256
+		meta["SHA1"] = sums.Sha1
 		meta["MD5sum"] = md5
 		meta["type"] = "apt"
-		writePackage(meta)
-		db.Write(owner, md5, header.Filename, meta)
+
+		indexLock.Lock()
+		defer indexLock.Unlock()
+		id := duplicate(meta)
+		// Suites share pool, so package of another suite must not be shadowed by file with the same path
+		if pool := poolFile(meta["Filename"]); len(pool) != 0 && pool != id {
+			log.Warn(meta["Filename"] + " already exists in pool, rejecting upload")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("File " + meta["Filename"] + " already exists in another suite"))
+			db.DropBlob(sums.Sha256)
+			return
+		}
+		if len(id) != 0 {
+			if r.FormValue("overwrite") != "true" || db.CheckRepo(owner, "apt", id) == 0 {
+				log.Warn(meta["Package"] + " " + meta["Version"] + " " + meta["Architecture"] + " already exists, rejecting upload")
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte("Package " + meta["Package"] + " version " + meta["Version"] + " for " + meta["Architecture"] + " already exists"))
+				db.DropBlob(sums.Sha256)
+				return
+			}
+			if id == md5 {
+				// The same file is uploaded again, nothing to replace
+				db.DropBlob(sums.Sha256)
+			} else {
+				db.Write(owner, md5, sums.Name, meta)
+				// Replaced package is removed for all its owners, so index never has two stanzas of the same version
+				for _, o := range db.FileField(id, "owner") {
+					if db.CheckRepo(o, "apt", id) != 0 {
+						db.Delete(o, "apt", id)
+					}
+				}
+				log.Info(meta["Package"] + " " + meta["Version"] + " " + meta["Architecture"] + " (" + id + ") is replaced by " + md5)
+			}
+		} else {
+			db.Write(owner, md5, sums.Name, meta)
+		}
+		rebuild(dist, component, meta["Architecture"])
 		w.Write([]byte(md5))
-		log.Info(meta["Filename"] + " saved to apt repo by " + owner)
+		log.Info(sums.Name + " saved to " + dist + "/" + component + " apt repo by " + owner)
 	}
 }
 
-func Download(w http.ResponseWriter, r *http.Request) {
-	file := r.URL.Query().Get("hash")
-	if len(file) == 0 {
-		file = strings.TrimPrefix(r.RequestURI, "/kurjun/rest/apt/")
-	}
-	if file != "Packages" && file != "InRelease" && file != "Release" {
-		file = db.LastHash(file, "apt")
+// indexFile checks if requested file is a part of repository metadata and returns its path in storage.
+// Indexes in storage root are left from flat repository layout, they are not updated anymore and not served.
+func indexFile(file string) (string, bool) {
+	if file = path.Clean("/" + file)[1:]; strings.HasPrefix(file, "dists/") {
+		return file, true
 	}
+	return "", false
+}
 
-	if f, err := os.Open(config.Storage.Path + file); err == nil {
-		defer f.Close()
-		io.Copy(w, f)
-	} else {
-		w.WriteHeader(http.StatusNotFound)
+// poolFile returns ID of binary package, source package description or source file located at path in repository pool.
+// File name alone is not unique, the same name may be used in different components.
+func poolFile(file string) string {
+	file = path.Clean("/" + file)[1:]
+	dir, name := path.Split(file)
+	dir = strings.TrimSuffix(dir, "/")
+	for _, k := range db.Search(path.Base(dir)) {
+		info := db.Info(k)
+		if db.CheckRepo("", "apt", k) == 0 {
+			continue
+		}
+		if len(info["kind"]) == 0 && info["Filename"] == file ||
+			info["kind"] == "source" && info["Directory"] == dir && info["name"] == name {
+			return k
+		}
+		if info["kind"] == "source" && info["Directory"] == dir {
+			files, _ := checksumList(info["Files"])
+			for _, f := range files {
+				if f.Name == name && db.CheckRepo("", "apt", f.Hash) != 0 {
+					return f.Hash
+				}
+			}
+		}
 	}
+	return ""
 }
 
-func readPackages() []string {
-	file, err := os.Open(config.Storage.Path + "Packages")
-	log.Check(log.WarnLevel, "Opening packages file", err)
-	defer file.Close()
-
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+// duplicate returns ID of binary package with the same name, version and architecture in the same suite and component,
+// if it exists in repo
+func duplicate(meta map[string]string) string {
+	dist, component := location(meta)
+	for _, k := range db.Search(meta["Package"]) {
+		info := db.Info(k)
+		if d, c := location(info); d != dist || c != component {
+			continue
+		}
+		if len(info["kind"]) == 0 && info["Package"] == meta["Package"] && info["Version"] == meta["Version"] &&
+			info["Architecture"] == meta["Architecture"] && db.CheckRepo("", "apt", k) != 0 {
+			return k
+		}
 	}
-	log.Check(log.WarnLevel, "Scanning packages list", scanner.Err())
-	return lines
+	return ""
 }
 
-func deleteInfo(hash string) {
-	list := readPackages()
-	if len(list) == 0 {
-		log.Warn("Empty packages list")
-		return
+// find returns ID of package with specified name and version. Name may be either package or file name.
+// If version is not specified, the highest version is returned.
+func find(name, version string) (id string) {
+	var latest string
+	for _, k := range db.Search(name) {
+		info := db.Info(k)
+		if info["Package"] != name && info["Source"] != name && info["name"] != name ||
+			len(version) != 0 && info["Version"] != version || db.CheckRepo("", "apt", k) == 0 {
+			continue
+		}
+		if len(id) == 0 || compareVersions(info["Version"], latest) > 0 {
+			id, latest = k, info["Version"]
+		}
 	}
+	return id
+}
 
-	var newlist, block string
-	changed, skip := false, false
-	for _, line := range list {
-		if len(line) != 0 && skip {
-			continue
-		} else if len(line) == 0 {
-			skip = false
-			if len(block) != 0 {
-				newlist = newlist + block + "\n"
-				block = ""
-			}
-		} else if len(line) != 0 && !skip {
-			if strings.HasSuffix(line, hash) {
-				block = ""
-				skip = true
-				changed = true
-			} else {
-				block = block + line + "\n"
+func Download(w http.ResponseWriter, r *http.Request) {
+	file := r.URL.Query().Get("hash")
+	if name := r.URL.Query().Get("name"); len(file) == 0 && len(name) != 0 {
+		file = find(name, r.URL.Query().Get("version"))
+	} else if len(file) == 0 {
+		file = strings.TrimPrefix(r.URL.Path, "/kurjun/rest/apt/")
+		// Repository indexes are kept on local disk, while packages are stored as other artifacts
+		if index, ok := indexFile(file); ok {
+			if f, err := os.Open(config.Storage.Path + index); err == nil {
+				defer f.Close()
+				io.Copy(w, f)
+				return
 			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(file, "pool/") {
+			file = poolFile(file)
+		} else {
+			// Packages of flat repository layout are referenced by file name only
+			file = db.LastHash(path.Base(file), "apt")
 		}
 	}
-	if changed {
-		log.Info("Updating packages list")
-		file, err := os.Create(config.Storage.Path + "Packages.new")
-		log.Check(log.WarnLevel, "Opening packages file", err)
-		defer file.Close()
 
-		_, err = file.WriteString(newlist)
-		log.Check(log.WarnLevel, "Writing new list", err)
-		log.Check(log.WarnLevel, "Replacing old list",
-			os.Rename(config.Storage.Path+"Packages.new", config.Storage.Path+"Packages"))
+	if f, fi, err := storage.Open(file); err == nil && len(file) != 0 {
+		defer f.Close()
+		w.Header().Set("ETag", "\""+file+"\"")
+		http.ServeContent(w, r, path.Base(r.URL.Path), fi.ModTime, f)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
 func Delete(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "DELETE" {
+		info := db.Info(r.URL.Query().Get("id"))
+		owner := db.CheckToken(r.URL.Query().Get("token"))
+		if len(owner) == 0 {
+			owner = strings.ToLower(db.DeployKey(r.URL.Query().Get("token"))["owner"])
+		}
+		// Source files belong to organization if package is deleted on its behalf
+		owner = db.ActingOwner(owner, "apt", r.URL.Query().Get("id"))
 		if hash := upload.Delete(w, r); len(hash) != 0 {
-			deleteInfo(hash)
+			dist, component := location(info)
+			if info["kind"] == "source" {
+				removeSourceFiles(owner, sourceFiles(info))
+				reindex(dist, component, "source")
+			} else {
+				reindex(dist, component, info["Architecture"])
+			}
 			w.Write([]byte("Removed"))
 			return
 		}
@@ -216,8 +347,25 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Info returns list of apt packages. Versions of the same package are sorted from the newest to the oldest.
 func Info(w http.ResponseWriter, r *http.Request) {
-	if info := download.Info("apt", r); len(info) != 0 {
+	if download.Paginated(r) {
+		download.Page("apt", w, r)
+		return
+	}
+	if !download.CheckQuery(w, r) {
+		return
+	}
+	items := download.List("apt", r)
+	if !download.Ordered(r) {
+		sort.SliceStable(items, func(i, j int) bool {
+			if items[i].Name != items[j].Name {
+				return items[i].Name < items[j].Name
+			}
+			return compareVersions(items[i].Version, items[j].Version) > 0
+		})
+	}
+	if info, err := json.Marshal(items); err == nil && len(items) != 0 {
 		w.Write(info)
 		return
 	}
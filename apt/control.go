@@ -0,0 +1,73 @@
+package apt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// field is a single field of Debian control paragraph. Value of multiline field
+// keeps its continuation lines, separated by newline, exactly as they were in source.
+type field struct {
+	Name  string
+	Value string
+}
+
+// paragraph is a set of control fields in their original order, as described in deb822(5)
+type paragraph []field
+
+// Get returns value of field. Field names are case-insensitive.
+func (p paragraph) Get(name string) string {
+	for _, f := range p {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Map converts paragraph to map of field names and values
+func (p paragraph) Map() map[string]string {
+	m := make(map[string]string, len(p))
+	for _, f := range p {
+		m[f.Name] = f.Value
+	}
+	return m
+}
+
+// parseControl reads Debian control data in RFC822-like format and returns list of its paragraphs.
+// Paragraphs are separated by empty lines, lines starting with space or tab continue value of previous field,
+// lines starting with '#' are comments. Only the first colon separates field name from value.
+func parseControl(r io.Reader) (list []paragraph, err error) {
+	var p paragraph
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case len(strings.TrimSpace(line)) == 0:
+			if len(p) != 0 {
+				list = append(list, p)
+				p = nil
+			}
+		case strings.HasPrefix(line, "#"):
+			continue
+		case line[0] == ' ' || line[0] == '\t':
+			if len(p) == 0 {
+				return nil, fmt.Errorf("Line %d: continuation line without field", n)
+			}
+			p[len(p)-1].Value += "\n" + line
+		default:
+			i := strings.Index(line, ":")
+			if i < 1 {
+				return nil, fmt.Errorf("Line %d: malformed field %q", n, line)
+			}
+			p = append(p, field{Name: strings.TrimSpace(line[:i]), Value: strings.TrimSpace(line[i+1:])})
+		}
+	}
+	if len(p) != 0 {
+		list = append(list, p)
+	}
+	return list, scanner.Err()
+}
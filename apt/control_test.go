@@ -0,0 +1,79 @@
+package apt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseControl(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []paragraph
+	}{
+		{"empty", "", nil},
+		{"single paragraph", "Package: foo\nVersion: 1.0\n", []paragraph{
+			{{"Package", "foo"}, {"Version", "1.0"}},
+		}},
+		{"no final newline", "Package: foo", []paragraph{
+			{{"Package", "foo"}},
+		}},
+		{"several paragraphs", "Package: foo\n\n\n \nPackage: bar\nArchitecture: all\n\n", []paragraph{
+			{{"Package", "foo"}},
+			{{"Package", "bar"}, {"Architecture", "all"}},
+		}},
+		{"continuation lines", "Description: short\n long text\n .\n\tmore\nSize: 1\n", []paragraph{
+			{{"Description", "short\n long text\n .\n\tmore"}, {"Size", "1"}},
+		}},
+		{"comments and CRLF", "# comment\r\nPackage: foo\r\n# another\r\nVersion:  1.0 \r\n", []paragraph{
+			{{"Package", "foo"}, {"Version", "1.0"}},
+		}},
+		{"colon in value", "Depends: libc6 (>= 2:2.14)\nHomepage: http://example.com/\n", []paragraph{
+			{{"Depends", "libc6 (>= 2:2.14)"}, {"Homepage", "http://example.com/"}},
+		}},
+		{"empty value", "Files:\n abc 10 foo.tar.gz\n", []paragraph{
+			{{"Files", "\n abc 10 foo.tar.gz"}},
+		}},
+	}
+	for _, c := range cases {
+		list, err := parseControl(strings.NewReader(c.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, c.expected) {
+			t.Errorf("%s: parsed %q, expected %q", c.name, list, c.expected)
+		}
+	}
+}
+
+func TestParseControlErrors(t *testing.T) {
+	cases := []struct {
+		input, err string
+	}{
+		{" continuation\n", "Line 1: continuation line without field"},
+		{"Package: foo\n\n\tvalue\n", "Line 3: continuation line without field"},
+		{"Package foo\n", `Line 1: malformed field "Package foo"`},
+		{"Package: foo\n: bar\n", `Line 2: malformed field ": bar"`},
+	}
+	for _, c := range cases {
+		if _, err := parseControl(strings.NewReader(c.input)); err == nil || err.Error() != c.err {
+			t.Errorf("parseControl(%q) error is %v, expected %q", c.input, err, c.err)
+		}
+	}
+}
+
+func TestParagraph(t *testing.T) {
+	p := paragraph{{"Package", "foo"}, {"Checksums-Sha256", "\n abc 1 foo.dsc"}}
+	if v := p.Get("package"); v != "foo" {
+		t.Errorf("Get is not case-insensitive, returned %q", v)
+	}
+	if v := p.Get("Version"); v != "" {
+		t.Errorf("Get of missing field returned %q", v)
+	}
+	expected := map[string]string{"Package": "foo", "Checksums-Sha256": "\n abc 1 foo.dsc"}
+	if m := p.Map(); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Map returned %q, expected %q", m, expected)
+	}
+}
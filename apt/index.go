@@ -0,0 +1,201 @@
+package apt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/ulikunitz/xz"
+
+	"github.com/subutai-io/gorjun/config"
+	"github.com/subutai-io/gorjun/db"
+)
+
+var (
+	indexLock sync.Mutex
+
+	// fieldOrder defines order of control fields in Packages index.
+	// Fields that are not listed here are sorted alphabetically and placed before Description.
+	fieldOrder = []string{
+		"Package", "Source", "Version", "Section", "Priority", "Architecture", "Essential",
+		"Maintainer", "Original-Maintainer", "Installed-Size", "Provides", "Pre-Depends", "Depends",
+		"Recommends", "Suggests", "Conflicts", "Breaks", "Replaces", "Enhances",
+		"Filename", "Size", "MD5sum", "SHA1", "SHA256", "SHA512", "Homepage",
+	}
+)
+
+// stanza formats apt record as a paragraph of index with fields in specified order.
+// Only control fields are used, Gorjun own record fields start with lower case letter and are skipped.
+func stanza(info map[string]string, order []string) []byte {
+	var buf bytes.Buffer
+	var extra []string
+	for k, v := range info {
+		if len(k) == 0 || len(v) == 0 || !unicode.IsUpper(rune(k[0])) || k == "Description" || in(k, order) {
+			continue
+		}
+		extra = append(extra, k)
+	}
+	sort.Strings(extra)
+
+	fields := append(append(append([]string{}, order...), extra...), "Description")
+	for _, k := range fields {
+		if v := info[k]; len(v) != 0 {
+			buf.WriteString(k + ": " + v + "\n")
+		}
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// writeIndex writes index file along with its gzip and xz compressed variants
+func writeIndex(path string, data []byte) error {
+	if err := writeFile(path, data); err != nil {
+		return err
+	}
+
+	var gz bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = gw.Write(data); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+	if err = writeFile(path+".gz", gz.Bytes()); err != nil {
+		return err
+	}
+
+	var x bytes.Buffer
+	xw, err := xz.NewWriter(&x)
+	if err != nil {
+		return err
+	}
+	if _, err = xw.Write(data); err != nil {
+		return err
+	}
+	if err = xw.Close(); err != nil {
+		return err
+	}
+	return writeFile(path+".xz", x.Bytes())
+}
+
+// retain filters out old versions of packages according to retention settings.
+// Records must be sorted by name and version, from the newest one.
+func retain(records []map[string]string) (list []map[string]string) {
+	versions := make(map[string][]string)
+	for _, info := range records {
+		dist, component := location(info)
+		name := info["Package"]
+		if info["kind"] == "source" {
+			name = info["Source"]
+		}
+		key := info["kind"] + "/" + dist + "/" + component + "/" + info["Architecture"] + "/" + name
+		if keep := config.AptRetention(name); !in(info["Version"], versions[key]) {
+			if keep >= 0 && len(versions[key]) > keep {
+				continue
+			}
+			versions[key] = append(versions[key], info["Version"])
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+// reindex regenerates Packages and Sources indexes from apt records in DB and updates Release files.
+// Indexes are replaced atomically, so clients never get partially written file.
+// Only indexes of specified suite, component and architecture are regenerated, empty value matches any of them.
+// Architecture "source" stands for Sources index.
+func reindex(dist, component, arch string) {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	rebuild(dist, component, arch)
+}
+
+// rebuild does the same as reindex, but must be called with indexLock held.
+// It allows to change DB records and indexes as a single operation.
+func rebuild(dist, component, arch string) {
+	affected := func(d, c, a string) bool {
+		return (len(dist) == 0 || d == dist) && (len(component) == 0 || c == component) && (len(arch) == 0 || a == arch)
+	}
+
+	var records []map[string]string
+	for _, id := range db.Items("apt") {
+		info := db.Info(id)
+		d, c := location(info)
+		if info["kind"] == "source" && len(info["Source"]) != 0 && affected(d, c, "source") ||
+			len(info["kind"]) == 0 && len(info["Package"]) != 0 && validName.MatchString(info["Architecture"]) &&
+				affected(d, c, info["Architecture"]) {
+			records = append(records, info)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i]["Package"] != records[j]["Package"] {
+			return records[i]["Package"] < records[j]["Package"]
+		}
+		if records[i]["Source"] != records[j]["Source"] {
+			return records[i]["Source"] < records[j]["Source"]
+		}
+		if c := compareVersions(records[i]["Version"], records[j]["Version"]); c != 0 {
+			return c > 0
+		}
+		return records[i]["name"] < records[j]["name"]
+	})
+	records = retain(records)
+
+	lists := make(map[string]*bytes.Buffer)
+	dists := make(map[string]bool)
+	for _, info := range records {
+		dist, component := location(info)
+		file, paragraph := indexPath(dist, component, info["Architecture"])+"Packages", stanza(info, fieldOrder)
+		if info["kind"] == "source" {
+			file, paragraph = sourcePath(dist, component)+"Sources", sourceStanza(info)
+		}
+		if lists[file] == nil {
+			lists[file] = new(bytes.Buffer)
+		}
+		lists[file].Write(paragraph)
+		dists[dist] = true
+	}
+
+	// Indexes which have no packages anymore are emptied but kept to not break clients configuration
+	packages, _ := filepath.Glob(config.Storage.Path + "dists/*/*/binary-*/Packages")
+	sources, _ := filepath.Glob(config.Storage.Path + "dists/*/*/source/Sources")
+	for _, file := range append(packages, sources...) {
+		// dists/<suite>/<component>/binary-<arch>/Packages or dists/<suite>/<component>/source/Sources
+		parts := strings.Split(strings.TrimPrefix(file, config.Storage.Path+"dists/"), "/")
+		if lists[file] == nil && affected(parts[0], parts[1], strings.TrimPrefix(parts[2], "binary-")) {
+			lists[file] = new(bytes.Buffer)
+			dists[parts[0]] = true
+		}
+	}
+
+	for file, list := range lists {
+		log.Check(log.WarnLevel, "Creating index directory", os.MkdirAll(filepath.Dir(file), 0755))
+		log.Check(log.WarnLevel, "Writing index "+file, writeIndex(file, list.Bytes()))
+	}
+	for dist := range dists {
+		updateRelease(dist)
+	}
+}
+
+// Reindex rebuilds apt repository indexes on demand. It requires admin permission.
+func Reindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	reindex("", "", "")
+	w.Write([]byte("Ok"))
+	log.Info("Apt repository indexes have been rebuilt")
+}
@@ -0,0 +1,137 @@
+package apt
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/config"
+	"github.com/subutai-io/gorjun/pgp"
+)
+
+var (
+	// indexes lists files of every component and architecture that are described in Release file
+	indexes = map[string][]string{
+		"binary": {"Packages", "Packages.gz", "Packages.xz"},
+		"source": {"Sources", "Sources.gz", "Sources.xz"},
+	}
+
+	checksums = []struct {
+		field string
+		hash  func() hash.Hash
+	}{
+		{"MD5Sum", md5.New},
+		{"SHA1", sha1.New},
+		{"SHA256", sha256.New},
+		{"SHA512", sha512.New},
+	}
+)
+
+// writeFile replaces file content atomically, so clients never receive partially written index
+func writeFile(path string, data []byte) error {
+	if err := ioutil.WriteFile(path+".new", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
+
+// release builds content of Release file of suite with checksums of every existing index file
+func release(dist string) []byte {
+	var components, archs []string
+	files := make(map[string][]byte)
+	root := config.Storage.Path + "dists/" + dist + "/"
+
+	dirs, _ := ioutil.ReadDir(root)
+	for _, component := range dirs {
+		if !component.IsDir() {
+			continue
+		}
+		components = append(components, component.Name())
+		subdirs, _ := ioutil.ReadDir(root + component.Name())
+		for _, sub := range subdirs {
+			kind := strings.Split(sub.Name(), "-")[0]
+			if !sub.IsDir() || indexes[kind] == nil {
+				continue
+			}
+			if arch := strings.TrimPrefix(sub.Name(), "binary-"); kind == "binary" && !in(arch, archs) {
+				archs = append(archs, arch)
+			}
+			for _, name := range indexes[kind] {
+				name = component.Name() + "/" + sub.Name() + "/" + name
+				if data, err := ioutil.ReadFile(root + name); err == nil {
+					files[name] = data
+				}
+			}
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.Strings(archs)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Origin: %s\n", config.Apt.Origin)
+	fmt.Fprintf(&buf, "Label: %s\n", config.Apt.Label)
+	fmt.Fprintf(&buf, "Suite: %s\n", dist)
+	fmt.Fprintf(&buf, "Codename: %s\n", dist)
+	fmt.Fprintf(&buf, "Date: %s\n", time.Now().UTC().Format(time.RFC1123))
+	fmt.Fprintf(&buf, "Architectures: %s\n", strings.Join(archs, " "))
+	fmt.Fprintf(&buf, "Components: %s\n", strings.Join(components, " "))
+	for _, sum := range checksums {
+		buf.WriteString(sum.field + ":\n")
+		for _, name := range names {
+			h := sum.hash()
+			h.Write(files[name])
+			fmt.Fprintf(&buf, " %x %d %s\n", h.Sum(nil), len(files[name]), name)
+		}
+	}
+	return buf.Bytes()
+}
+
+func in(str string, list []string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// updateRelease regenerates Release file of suite and signs it with server key into InRelease and Release.gpg.
+// If signing key is not configured, stale signatures are removed to not confuse apt clients.
+// It must be called with indexLock held.
+func updateRelease(dist string) {
+	root := config.Storage.Path + "dists/" + dist + "/"
+	data := release(dist)
+	if log.Check(log.WarnLevel, "Writing Release file", writeFile(root+"Release", data)) {
+		return
+	}
+
+	inrelease, err := pgp.ClearSign(data)
+	if log.Check(log.WarnLevel, "Signing InRelease file", err) {
+		os.Remove(root + "InRelease")
+		os.Remove(root + "Release.gpg")
+		return
+	}
+	log.Check(log.WarnLevel, "Writing InRelease file", writeFile(root+"InRelease", inrelease))
+
+	signature, err := pgp.DetachSign(data)
+	if log.Check(log.WarnLevel, "Signing Release file", err) {
+		os.Remove(root + "Release.gpg")
+		return
+	}
+	log.Check(log.WarnLevel, "Writing Release.gpg file", writeFile(root+"Release.gpg", signature))
+}
@@ -0,0 +1,249 @@
+package apt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/subutai-io/agent/log"
+	"golang.org/x/crypto/openpgp/clearsign"
+
+	"github.com/subutai-io/gorjun/db"
+	"github.com/subutai-io/gorjun/storage"
+	"github.com/subutai-io/gorjun/upload"
+)
+
+// sourceOrder defines order of fields in Sources index
+var sourceOrder = []string{
+	"Package", "Binary", "Version", "Maintainer", "Uploaders", "Build-Depends", "Build-Depends-Indep",
+	"Build-Conflicts", "Architecture", "Standards-Version", "Format", "Files", "Vcs-Browser", "Vcs-Git",
+	"Checksums-Sha1", "Checksums-Sha256", "Homepage", "Package-List", "Directory", "Priority", "Section",
+}
+
+// checksum describes single file listed in .dsc
+type checksum struct {
+	Hash string
+	Size int64
+	Name string
+}
+
+// checksumList parses multiline field like Files or Checksums-Sha256 of .dsc file
+func checksumList(value string) (list []checksum, err error) {
+	for _, line := range strings.Split(value, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("Malformed checksum line %q", line)
+		}
+		size, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(f[2], "/\\") || strings.HasPrefix(f[2], ".") {
+			return nil, fmt.Errorf("Invalid file name %q", f[2])
+		}
+		list = append(list, checksum{Hash: f[0], Size: size, Name: f[2]})
+	}
+	return list, nil
+}
+
+// readDsc parses source package description. PGP signature wrapper is removed if present.
+func readDsc(hash string) (paragraph, error) {
+	f, err := storage.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := clearsign.Decode(data); block != nil {
+		data = block.Plaintext
+	}
+	list, err := parseControl(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 || len(list[0].Get("Source")) == 0 || len(list[0].Get("Files")) == 0 {
+		return nil, fmt.Errorf("Not a source package description")
+	}
+	return list[0], nil
+}
+
+// sourceFile stores file referenced by .dsc and checks it against expected checksums.
+// If the file is not attached to request, it must be already present in repository.
+func sourceFile(owner string, parts []*multipart.FileHeader, md5 checksum, sha256 string) (sums upload.Sums, stored bool, err error) {
+	for _, part := range parts {
+		if part.Filename != md5.Name {
+			continue
+		}
+		sums, err := upload.Store(owner, part)
+		if err != nil {
+			return sums, false, err
+		}
+		if sums.Md5 != md5.Hash || sums.Size != md5.Size || len(sha256) != 0 && sums.Sha256 != sha256 {
+			return sums, true, fmt.Errorf("Checksum mismatch for %s", md5.Name)
+		}
+		return sums, true, nil
+	}
+	if info := db.Info(md5.Hash); info["name"] == md5.Name && db.CheckRepo("", "apt", md5.Hash) != 0 {
+		if sum := info["SHA256"]; len(sha256) != 0 && len(sum) != 0 && sum != sha256 {
+			return sums, false, fmt.Errorf("Checksum mismatch for %s", md5.Name)
+		}
+		return upload.Sums{Md5: md5.Hash}, false, nil
+	}
+	return sums, false, fmt.Errorf("File %s is missing", md5.Name)
+}
+
+// uploadSource handles apt source package upload: .dsc file and source tarballs referenced by it.
+// All files are checked against checksums from .dsc and stored the same way as binary packages.
+func uploadSource(w http.ResponseWriter, r *http.Request, sums upload.Sums, owner string) {
+	hash := sums.Md5
+	var stored []upload.Sums
+	defer func() {
+		for _, v := range stored {
+			upload.Release(owner, v)
+		}
+	}()
+	fail := func(code int, err error) {
+		log.Warn(err.Error())
+		w.WriteHeader(code)
+		w.Write([]byte(err.Error()))
+		for _, v := range stored {
+			db.DropBlob(v.Sha256)
+		}
+		db.DropBlob(sums.Sha256)
+	}
+
+	dsc, err := readDsc(hash)
+	if err != nil {
+		fail(http.StatusUnsupportedMediaType, err)
+		return
+	}
+	meta := dsc.Map()
+	meta["distribution"] = r.FormValue("distribution")
+	meta["component"] = r.FormValue("component")
+	dist, component := location(meta)
+	if !validName.MatchString(dist) || !validName.MatchString(component) || !validName.MatchString(meta["Source"]) {
+		fail(http.StatusBadRequest, fmt.Errorf("Invalid distribution, component or source package name"))
+		return
+	}
+	// Suites share pool, so description of another suite must not be shadowed by file with the same path
+	if pool := poolFile(poolPath(component, meta["Source"], sums.Name)); len(pool) != 0 && pool != hash {
+		fail(http.StatusConflict, fmt.Errorf("File %s already exists in another suite", sums.Name))
+		return
+	}
+
+	files, err := checksumList(dsc.Get("Files"))
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	list, err := checksumList(dsc.Get("Checksums-Sha256"))
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	sha256 := make(map[string]string)
+	for _, v := range list {
+		sha256[v.Name] = v.Hash
+	}
+
+	var parts []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		parts = r.MultipartForm.File["file"]
+	}
+	// Attached tarballs are stored under their own names, so deploy key must allow them as well
+	for _, part := range parts {
+		for _, file := range files {
+			if part.Filename == file.Name && upload.Denied(w, r, file.Name) {
+				db.DropBlob(sums.Sha256)
+				return
+			}
+		}
+	}
+	for _, file := range files {
+		part, isNew, err := sourceFile(owner, parts, file, sha256[file.Name])
+		if isNew {
+			stored = append(stored, part)
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	for _, file := range stored {
+		db.Write(owner, file.Md5, file.Name, map[string]string{
+			"type":   "apt",
+			"kind":   "source-file",
+			"SHA256": file.Sha256,
+		})
+	}
+
+	meta["distribution"], meta["component"] = dist, component
+	meta["Directory"] = strings.TrimSuffix(poolPath(component, meta["Source"], sums.Name), "/"+sums.Name)
+	meta["Size"] = strconv.FormatInt(sums.Size, 10)
+	meta["SHA256"] = sums.Sha256
+	meta["SHA1"] = sums.Sha1
+	meta["MD5sum"] = hash
+	meta["kind"] = "source"
+	meta["type"] = "apt"
+	db.Write(owner, hash, sums.Name, meta)
+	reindex(dist, component, "source")
+	w.Write([]byte(hash))
+	log.Info(sums.Name + " source package saved to " + dist + "/" + component + " apt repo by " + owner)
+}
+
+// sourceStanza converts .dsc record to paragraph of Sources index, adding .dsc file itself to files lists
+func sourceStanza(info map[string]string) []byte {
+	m := make(map[string]string)
+	for k, v := range info {
+		switch k {
+		case "Source", "Size", "MD5sum", "SHA1", "SHA256", "SHA512", "Filename":
+		default:
+			m[k] = v
+		}
+	}
+	m["Package"] = info["Source"]
+	for field, sum := range map[string]string{"Files": "MD5sum", "Checksums-Sha1": "SHA1", "Checksums-Sha256": "SHA256"} {
+		if len(m[field]) != 0 && len(info[sum]) != 0 {
+			m[field] += "\n " + info[sum] + " " + info["Size"] + " " + info["name"]
+		}
+	}
+	return stanza(m, sourceOrder)
+}
+
+// sourceFiles returns hashes of files referenced by .dsc record
+func sourceFiles(info map[string]string) (list []string) {
+	files, _ := checksumList(info["Files"])
+	for _, file := range files {
+		list = append(list, file.Hash)
+	}
+	return list
+}
+
+// removeSourceFiles deletes files of removed source package, which are not referenced by other source packages
+func removeSourceFiles(owner string, files []string) {
+	used := make(map[string]bool)
+	for _, id := range db.Items("apt") {
+		if info := db.Info(id); info["kind"] == "source" {
+			for _, hash := range sourceFiles(info) {
+				used[hash] = true
+			}
+		}
+	}
+	for _, hash := range files {
+		if !used[hash] && db.CheckRepo(owner, "apt", hash) != 0 {
+			db.Delete(owner, "apt", hash)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package apt
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/subutai-io/gorjun/download"
+)
+
+func init() {
+	download.VersionOrder("apt", compareVersions)
+}
+
+// splitVersion splits Debian package version to epoch, upstream version and revision
+func splitVersion(version string) (epoch int, upstream, revision string) {
+	upstream = version
+	if i := strings.Index(upstream, ":"); i != -1 {
+		epoch, _ = strconv.Atoi(upstream[:i])
+		upstream = upstream[i+1:]
+	}
+	if i := strings.LastIndex(upstream, "-"); i != -1 {
+		revision = upstream[i+1:]
+		upstream = upstream[:i]
+	}
+	return epoch, upstream, revision
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// order returns weight of character in version string: tilde sorts before anything, even the end of string,
+// letters sort before other characters.
+func order(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+	switch c := s[i]; {
+	case isDigit(c):
+		return 0
+	case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		return int(c)
+	case c == '~':
+		return -1
+	default:
+		return int(c) + 256
+	}
+}
+
+// verrevcmp compares upstream versions or revisions the same way as dpkg does:
+// non-digit parts are compared lexically using order, digit parts are compared numerically.
+func verrevcmp(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && !isDigit(a[i]) || j < len(b) && !isDigit(b[j]) {
+			if ac, bc := order(a, i), order(b, j); ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		diff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if diff == 0 {
+				diff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if diff != 0 {
+			return diff
+		}
+	}
+	return 0
+}
+
+// compareVersions compares two Debian package versions taking into account epochs and tildes.
+// It returns negative value if a is older than b, positive if newer and zero if versions are equal.
+func compareVersions(a, b string) int {
+	ea, ua, ra := splitVersion(a)
+	eb, ub, rb := splitVersion(b)
+	if ea != eb {
+		return ea - eb
+	}
+	if c := verrevcmp(ua, ub); c != 0 {
+		return c
+	}
+	return verrevcmp(ra, rb)
+}
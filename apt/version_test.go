@@ -0,0 +1,93 @@
+package apt
+
+import "testing"
+
+func sign(v int) int {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestSplitVersion(t *testing.T) {
+	cases := []struct {
+		version, upstream, revision string
+		epoch                       int
+	}{
+		{"1.0", "1.0", "", 0},
+		{"1.0-1", "1.0", "1", 0},
+		{"2:1.0-1ubuntu2", "1.0", "1ubuntu2", 2},
+		{"1.0-rc1-3", "1.0-rc1", "3", 0},
+		{"0:7.4.052", "7.4.052", "", 0},
+	}
+	for _, c := range cases {
+		epoch, upstream, revision := splitVersion(c.version)
+		if epoch != c.epoch || upstream != c.upstream || revision != c.revision {
+			t.Errorf("splitVersion(%q) = %d, %q, %q, expected %d, %q, %q",
+				c.version, epoch, upstream, revision, c.epoch, c.upstream, c.revision)
+		}
+	}
+}
+
+func TestVerrevcmp(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"1", "1", 0},
+		{"007", "7", 0},
+		{"0", "", 0},
+		{"1", "2", -1},
+		{"10", "9", 1},
+		{"2.30", "2.4", 1},
+		{"1.0", "1.0.0", -1},
+		{"a", "b", -1},
+		{"1a", "1", 1},
+		{"1a", "1+", -1},
+		{"1~", "1", -1},
+		{"1~~", "1~", -1},
+		{"1~rc1", "1~beta", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0+dfsg", "1.0", 1},
+		{"1ubuntu1", "1", 1},
+	}
+	for _, c := range cases {
+		if r := sign(verrevcmp(c.a, c.b)); r != c.expected {
+			t.Errorf("verrevcmp(%q, %q) = %d, expected %d", c.a, c.b, r, c.expected)
+		}
+		if r := sign(verrevcmp(c.b, c.a)); r != -c.expected {
+			t.Errorf("verrevcmp(%q, %q) = %d, expected %d", c.b, c.a, r, -c.expected)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1.0-0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1:0.1", "2.0", 1},
+		{"1.2.3-1~bpo9+1", "1.2.3-1", -1},
+		{"1.0~rc1-1", "1.0-1", -1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"7.0.0-1", "7.0-1", 1},
+	}
+	for _, c := range cases {
+		if r := sign(compareVersions(c.a, c.b)); r != c.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", c.a, c.b, r, c.expected)
+		}
+		if r := sign(compareVersions(c.b, c.a)); r != -c.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", c.b, c.a, r, -c.expected)
+		}
+	}
+}
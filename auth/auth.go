@@ -1,17 +1,17 @@
 package auth
 
 import (
-	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/subutai-io/agent/log"
 
+	"github.com/subutai-io/gorjun/config"
 	"github.com/subutai-io/gorjun/db"
 	"github.com/subutai-io/gorjun/pgp"
 )
@@ -19,7 +19,7 @@ import (
 func Register(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		r.ParseMultipartForm(32 << 20)
-		if strings.Split(r.RemoteAddr, ":")[0] == "127.0.0.1" && len(r.MultipartForm.Value["name"]) > 0 && len(r.MultipartForm.Value["key"]) > 0 {
+		if db.Allowed(Requester(r, "admin"), "admin") && len(r.MultipartForm.Value["name"]) > 0 && len(r.MultipartForm.Value["key"]) > 0 {
 			name := r.MultipartForm.Value["name"][0]
 			key := r.MultipartForm.Value["key"][0]
 
@@ -29,7 +29,13 @@ func Register(w http.ResponseWriter, r *http.Request) {
 			db.RegisterUser([]byte(name), []byte(key))
 			return
 		} else if len(r.MultipartForm.Value["key"]) > 0 {
-			key := pgp.Verify("Hub", r.MultipartForm.Value["key"][0])
+			// Key should be signed by administrator
+			var key string
+			for _, admin := range db.RoleUsers("admin") {
+				if key = pgp.Verify(admin, r.MultipartForm.Value["key"][0]); len(key) != 0 {
+					break
+				}
+			}
 			if len(key) == 0 {
 				w.Write([]byte("Signature check failed"))
 				w.WriteHeader(http.StatusForbidden)
@@ -54,13 +60,14 @@ func Register(w http.ResponseWriter, r *http.Request) {
 }
 
 func Token(w http.ResponseWriter, r *http.Request) {
-	rand.Seed(time.Now().UnixNano())
 	if r.Method == http.MethodGet {
 		name := r.URL.Query().Get("user")
 		if len(name) != 0 {
-			hash := md5.New()
-			hash.Write([]byte(fmt.Sprint(time.Now().String(), name, rand.Float64())))
-			authID := fmt.Sprintf("%x", hash.Sum(nil))
+			authID, err := random(16)
+			if log.Check(log.WarnLevel, "Generating auth challenge", err) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 			db.SaveAuthID(name, authID)
 			w.Write([]byte(authID))
 		}
@@ -73,10 +80,31 @@ func Token(w http.ResponseWriter, r *http.Request) {
 			log.Warn(r.RemoteAddr + " - empty user name or message filed")
 			return
 		}
+		scope := db.DefaultScopes
+		if len(r.FormValue("scope")) != 0 {
+			scope = strings.Split(r.FormValue("scope"), ",")
+			for _, v := range scope {
+				if !in(v, db.Scopes) {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("Unknown scope " + v))
+					return
+				}
+			}
+		}
 		authid := pgp.Verify(name, message)
-		if db.CheckAuthID(authid) == name {
-			token := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprint(time.Now().String(), name, rand.Float64()))))
-			db.SaveToken(name, fmt.Sprintf("%x", sha256.Sum256([]byte(token))))
+		if db.CheckAuthID(name, authid) {
+			// Quota management is also done with admin scope, so quota managers may request it too
+			if in("admin", scope) && !db.Allowed(name, "admin") && !db.Allowed(name, "quota") {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("User is not allowed to request admin scope"))
+				return
+			}
+			token, err := random(32)
+			if log.Check(log.WarnLevel, "Generating token", err) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			db.SaveToken(name, fmt.Sprintf("%x", sha256.Sum256([]byte(token))), scope, r.FormValue("repo"), config.TokenTTL())
 			w.Write([]byte(token))
 		} else {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -85,6 +113,15 @@ func Token(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// random returns hex encoded string of n random bytes
+func random(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func Validate(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	if len(token) == 0 {
@@ -130,13 +167,13 @@ func Key(w http.ResponseWriter, r *http.Request) {
 
 func Sign(w http.ResponseWriter, r *http.Request) {
 	r.ParseMultipartForm(32 << 20)
-	if len(r.MultipartForm.Value["token"]) == 0 || len(db.CheckToken(r.MultipartForm.Value["token"][0])) == 0 {
+	if len(r.MultipartForm.Value["token"]) == 0 || len(db.CheckTokenScope(r.MultipartForm.Value["token"][0], "upload", "")) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Not authorized"))
 		log.Warn(r.RemoteAddr + " - rejecting unauthorized sign request")
 		return
 	}
-	owner := db.CheckToken(r.MultipartForm.Value["token"][0])
+	owner := db.CheckTokenScope(r.MultipartForm.Value["token"][0], "upload", "")
 	if len(r.MultipartForm.Value["signature"]) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Empty signature"))
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// DeployKeys manages deploy keys of authorized user, which are used by automated builds instead of tokens.
+// GET lists keys, POST creates key with name, optional comma separated lists of repos and artifact name
+// patterns and returns its secret, which is not stored and can not be shown again. DELETE removes key by name.
+func DeployKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	// Deploy key allows both uploads and deletions, so it can not be created with narrower token
+	token := r.FormValue("token")
+	owner := strings.ToLower(db.CheckTokenScope(token, "upload", ""))
+	if len(owner) == 0 || !strings.EqualFold(db.CheckTokenScope(token, "delete", ""), owner) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+
+	if r.Method == "GET" {
+		list := db.DeployKeys(owner)
+		if list == nil {
+			list = []map[string]string{}
+		}
+		js, _ := json.Marshal(list)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	}
+
+	name := r.FormValue("name")
+	if len(name) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please specify key name"))
+		return
+	}
+	if r.Method == "DELETE" {
+		if !db.RemoveDeployKey(owner, name) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Deploy key not found"))
+			return
+		}
+		log.Info("Deploy key " + name + " of " + owner + " removed")
+		w.Write([]byte("Removed"))
+		return
+	}
+
+	var repos, patterns []string
+	for _, v := range strings.Split(r.FormValue("repo"), ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			repos = append(repos, v)
+		}
+	}
+	// Key can not give access beyond repo restriction of token which creates it
+	if repo := db.TokenRepo(token); len(repo) != 0 && (len(repos) != 1 || repos[0] != repo) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Token is restricted to " + repo + " repo"))
+		return
+	}
+	for _, v := range strings.Split(r.FormValue("pattern"), ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			if _, err := path.Match(v, ""); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid pattern " + v))
+				return
+			}
+			patterns = append(patterns, v)
+		}
+	}
+	secret, err := random(32)
+	if log.Check(log.WarnLevel, "Generating deploy key", err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to generate key"))
+		return
+	}
+	if !db.SaveDeployKey(owner, name, secret, repos, patterns) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Deploy key " + name + " already exists"))
+		return
+	}
+	log.Info("Deploy key " + name + " created by " + owner)
+	w.Write([]byte(secret))
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+var orgName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// Orgs manages organizations. GET returns members of organization with their roles to its members,
+// or organizations of requester if none is specified. POST creates organization owned by requester, or sets role of member
+// if user is specified. DELETE removes member, or organization itself if it does not own any artifacts.
+// Members are managed by organization owners, and any member may leave it.
+func Orgs(w http.ResponseWriter, r *http.Request) {
+	org := strings.ToLower(r.FormValue("org"))
+	user := strings.ToLower(r.FormValue("user"))
+	requester := strings.ToLower(Requester(r, "share"))
+
+	if r.Method == "GET" {
+		if len(requester) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Not authorized"))
+			return
+		}
+		var js []byte
+		if len(org) != 0 {
+			if !db.IsOrg(org) || len(db.OrgRole(org, requester)) == 0 && !db.Allowed(requester, "admin") {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("Organization not found"))
+				return
+			}
+			js, _ = json.Marshal(db.OrgMembers(org))
+		} else {
+			js, _ = json.Marshal(db.UserOrgs(requester))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	} else if r.Method != "POST" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+
+	if len(requester) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+	if !orgName.MatchString(org) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid organization name"))
+		return
+	}
+	if r.Method == "POST" && len(user) == 0 {
+		if !db.CreateOrg(org, requester) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("Name " + org + " is already taken"))
+			return
+		}
+		log.Info("Organization " + org + " created by " + requester)
+		w.Write([]byte("Ok"))
+		return
+	}
+	if !db.IsOrg(org) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Organization not found"))
+		return
+	}
+	if db.OrgRole(org, requester) != "owner" && (r.Method == "POST" || user != requester) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Organization is managed by its owners"))
+		return
+	}
+
+	if r.Method == "DELETE" && len(user) == 0 {
+		if !db.DeleteOrg(org) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("Organization still owns artifacts"))
+			return
+		}
+		log.Info("Organization " + org + " removed by " + requester)
+		w.Write([]byte("Removed"))
+		return
+	}
+
+	role := r.FormValue("role")
+	if len(role) == 0 {
+		role = "member"
+	}
+	if r.Method == "POST" && (!in(role, db.OrgRoles) || db.IsOrg(user) || len(db.UserKeys(user)) == 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Unknown role " + role + " or user " + user))
+		return
+	}
+	if db.OrgRole(org, user) == "owner" && (r.Method == "DELETE" || role != "owner") && owners(org) == 1 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Organization must have at least one owner"))
+		return
+	}
+	if r.Method == "POST" {
+		db.SetOrgMember(org, user, role)
+		log.Info("User " + user + " joined " + org + " as " + role + ", added by " + requester)
+		w.Write([]byte("Ok"))
+	} else {
+		db.RemoveOrgMember(org, user)
+		log.Info("User " + user + " removed from " + org + " by " + requester)
+		w.Write([]byte("Removed"))
+	}
+}
+
+// owners returns number of owners of organization
+func owners(org string) (n int) {
+	for _, role := range db.OrgMembers(org) {
+		if role == "owner" {
+			n++
+		}
+	}
+	return n
+}
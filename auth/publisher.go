@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// Publishers manages list of verified publishers. GET returns the list,
+// POST adds user to it and DELETE removes user, both require admin permission.
+func Publishers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		list := db.Publishers()
+		if list == nil {
+			list = []string{}
+		}
+		js, _ := json.Marshal(list)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	} else if r.Method != "POST" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+
+	admin := Requester(r, "admin")
+	user := r.FormValue("user")
+	if len(user) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please specify user"))
+		return
+	}
+
+	if r.Method == "POST" {
+		db.AddPublisher(user, admin)
+		log.Info(user + " added to verified publishers by " + admin)
+	} else {
+		db.RemovePublisher(user)
+		log.Info(user + " removed from verified publishers by " + admin)
+	}
+	w.Write([]byte("Ok"))
+}
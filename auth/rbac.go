@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// Handlers are wrapped with Require, which checks that roles of requester grant permission needed for request.
+// Requester is identified by token passed in "token" header or form value, or inside "json" form value of share
+// requests. Deploy keys act on behalf of their owners in uploads and deletions only. Anonymous requests are
+// allowed to read public artifacts. The first administrator is granted from command line: gorjun admin.
+
+// maxFormSize limits part of multipart body read to find credentials of request which has no token in header or URL.
+// Only fields preceding the first file are read, so uploads are not spooled to disk before they are authorized.
+const maxFormSize = 1 << 20
+
+// scopes maps permissions to token scopes which are required to use them, other permissions have scopes of the same name
+var scopes = map[string]string{"quota": "admin"}
+
+// Require wraps handler with check of requester permission. If methods are specified, only requests
+// with these methods are checked.
+func Require(permission string, handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(methods) != 0 && !in(r.Method, methods) {
+			handler(w, r)
+			return
+		}
+		if len(credentials(r)) == 0 {
+			if permission != "read" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Not authorized"))
+				return
+			}
+		} else if user := Requester(r, permission); len(user) == 0 && permission != "read" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Not authorized"))
+			return
+		} else if len(user) != 0 && !db.Allowed(user, permission) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Requester returns name of user who sent request, if credentials of request can be used for permission
+func Requester(r *http.Request, permission string) string {
+	secret := credentials(r)
+	scope := permission
+	if s, ok := scopes[permission]; ok {
+		scope = s
+	}
+	if name := db.CheckTokenScope(secret, scope, ""); len(name) != 0 {
+		return name
+	}
+	if permission == "upload" || permission == "delete" {
+		if key := db.DeployKey(secret); key != nil {
+			return key["owner"]
+		}
+	}
+	return ""
+}
+
+// credentials returns token or deploy key passed with request
+func credentials(r *http.Request) string {
+	if token := r.Header.Get("token"); len(token) != 0 {
+		return token
+	}
+	if token := r.URL.Query().Get("token"); len(token) != 0 {
+		return token
+	}
+	if r.MultipartForm == nil && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return formToken(r)
+	}
+	if token := r.FormValue("token"); len(token) != 0 {
+		return token
+	}
+	return jsonToken(r.FormValue("json"))
+}
+
+// formToken looks for token in multipart fields preceding the first file. Read part of body is put back,
+// so handler parses the whole form as usual.
+func formToken(r *http.Request) string {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || len(params["boundary"]) == 0 {
+		return ""
+	}
+	body, consumed := r.Body, new(bytes.Buffer)
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(consumed, body), body}
+	}()
+	form := multipart.NewReader(io.TeeReader(io.LimitReader(body, maxFormSize), consumed), params["boundary"])
+	for {
+		part, err := form.NextPart()
+		if err != nil || len(part.FileName()) != 0 {
+			return ""
+		}
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			return ""
+		}
+		switch part.FormName() {
+		case "token":
+			if len(value) != 0 {
+				return string(value)
+			}
+		case "json":
+			if token := jsonToken(string(value)); len(token) != 0 {
+				return token
+			}
+		}
+	}
+}
+
+// jsonToken returns token from "json" form value of share requests
+func jsonToken(v string) string {
+	var data struct {
+		Token string `json:"token"`
+	}
+	if len(v) != 0 && json.Unmarshal([]byte(v), &data) == nil {
+		return data.Token
+	}
+	return ""
+}
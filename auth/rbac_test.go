@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFormToken(t *testing.T) {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("token", "secret")
+	file, _ := form.CreateFormFile("file", "big.bin")
+	file.Write(make([]byte, 2*maxFormSize))
+	form.WriteField("json", `{"token":"late"}`)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/kurjun/rest/raw/upload", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if token := credentials(r); token != "secret" {
+		t.Errorf("Token of upload larger than form limit is %q, expected secret", token)
+	}
+	if token := credentials(r); token != "secret" {
+		t.Errorf("Token of the same request is %q on second read, expected secret", token)
+	}
+	if err := r.ParseMultipartForm(1 << 10); err != nil {
+		t.Fatalf("Body is not restored after reading token: %v", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+	if f := r.MultipartForm.File["file"]; len(f) != 1 || f[0].Size != 2*maxFormSize {
+		t.Errorf("Uploaded file is not restored: %v", f)
+	}
+
+	body = new(bytes.Buffer)
+	form = multipart.NewWriter(body)
+	file, _ = form.CreateFormFile("file", "small.bin")
+	file.Write([]byte("data"))
+	form.WriteField("token", "secret")
+	form.Close()
+	r = httptest.NewRequest("POST", "/kurjun/rest/raw/upload", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if token := credentials(r); token != "" {
+		t.Errorf("Token following file is used: %q", token)
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// Roles shows and changes roles of users. GET returns roles of user, POST assigns role
+// and DELETE removes it, both require admin permission.
+func Roles(w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	if len(user) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please specify user"))
+		return
+	}
+	if r.Method == "GET" {
+		list := db.UserRoles(user)
+		if list == nil {
+			list = []string{}
+		}
+		js, _ := json.Marshal(list)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	} else if r.Method != "POST" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+
+	role := r.FormValue("role")
+	if _, ok := db.RolePermissions[role]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Unknown role " + role))
+		return
+	}
+	admin := Requester(r, "admin")
+	if r.Method == "POST" {
+		db.GrantRole(user, role)
+		log.Info("Role " + role + " granted to " + user + " by " + admin)
+	} else {
+		db.RevokeRole(user, role)
+		log.Info("Role " + role + " revoked from " + user + " by " + admin)
+	}
+	w.Write([]byte("Ok"))
+}
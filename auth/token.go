@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// Tokens lists and revokes API tokens. GET returns tokens of authorized user, DELETE revokes token
+// specified by its id. Administrators may manage tokens of other users with "user" parameter.
+// Any valid token manages tokens of its owner, tokens of other users need "admin" scope and role.
+func Tokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	user := db.CheckToken(r.FormValue("token"))
+	if len(user) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+	owner := user
+	if other := r.FormValue("user"); len(other) != 0 && other != user {
+		if !db.Allowed(db.CheckTokenScope(r.FormValue("token"), "admin", ""), "admin") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden"))
+			return
+		}
+		owner = other
+	}
+
+	if r.Method == "GET" {
+		list := db.Tokens(owner)
+		if list == nil {
+			list = []map[string]string{}
+		}
+		js, _ := json.Marshal(list)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	}
+	if id := r.FormValue("id"); len(id) == 0 || !db.RevokeToken(id, owner) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Token not found"))
+		return
+	}
+	log.Info("Token of " + owner + " revoked by " + user)
+	w.Write([]byte("Revoked"))
+}
+
+// Expire periodically removes expired tokens and authentication challenges
+func Expire() {
+	for {
+		if n := db.ExpireTokens(); n != 0 {
+			log.Info(strconv.Itoa(n) + " expired tokens and challenges removed")
+		}
+		time.Sleep(10 * time.Minute)
+	}
+}
+
+func in(str string, list []string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
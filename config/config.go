@@ -2,6 +2,7 @@ package config
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/subutai-io/agent/log"
 	"gopkg.in/gcfg.v1"
@@ -17,8 +18,40 @@ type dbConfig struct {
 	Path string
 }
 type fileConfig struct {
-	Path      string
-	Userquota string
+	Path         string
+	Tmp          string
+	Backend      string
+	Userquota    string
+	Uploadttl    string
+	Sharedquota  string
+	Fsckinterval string
+	Fsckrepair   bool
+	Fsckverify   bool
+}
+type s3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Accesskey string
+	Secretkey string
+}
+type aptConfig struct {
+	Origin       string
+	Label        string
+	Distribution string
+	Component    string
+	Retention    int
+}
+type packageConfig struct {
+	Retention int
+}
+type authConfig struct {
+	Tokenttl     string
+	Challengettl string
+}
+type pgpConfig struct {
+	Key        string
+	Passphrase string
 }
 
 type configFile struct {
@@ -26,6 +59,11 @@ type configFile struct {
 	CDN     cdnConfig
 	Network networkConfig
 	Storage fileConfig
+	S3      s3Config
+	Apt     aptConfig
+	PGP     pgpConfig
+	Auth    authConfig
+	Package map[string]*packageConfig
 }
 
 const defaultConfig = `
@@ -40,7 +78,36 @@ const defaultConfig = `
 
 	[storage]
 	path = /opt/gorjun/data/files/
+	tmp = /opt/gorjun/data/tmp/
+	backend = local
 	userquota = 2G
+	uploadttl = 24h
+	sharedquota = full
+	fsckinterval = 0
+	fsckrepair = false
+	fsckverify = false
+
+	[s3]
+	endpoint =
+	region = us-east-1
+	bucket =
+	accesskey =
+	secretkey =
+
+	[apt]
+	origin = Subutai
+	label = Subutai
+	distribution = stable
+	component = main
+	retention = -1
+
+	[pgp]
+	key =
+	passphrase =
+
+	[auth]
+	tokenttl = 1h
+	challengettl = 10m
 `
 
 var (
@@ -50,6 +117,10 @@ var (
 	CDN     cdnConfig
 	Network networkConfig
 	Storage fileConfig
+	S3      s3Config
+	Apt     aptConfig
+	PGP     pgpConfig
+	Auth    authConfig
 )
 
 func init() {
@@ -66,6 +137,10 @@ func init() {
 	// CDN      = "https://cdn.subut.ai:8338"
 	Network = config.Network
 	Storage = config.Storage
+	S3 = config.S3
+	Apt = config.Apt
+	PGP = config.PGP
+	Auth = config.Auth
 }
 
 func DefaultQuota() int {
@@ -84,3 +159,51 @@ func DefaultQuota() int {
 	}
 	return v * multiplier
 }
+
+// AptRetention returns number of older versions of apt package which are kept in index besides the latest one.
+// It can be set for particular package in [package "name"] section. Negative value means to keep all versions.
+func AptRetention(name string) int {
+	if p, ok := config.Package[name]; ok && p != nil {
+		return p.Retention
+	}
+	return Apt.Retention
+}
+
+// UploadTTL returns time after which inactive chunked upload session expires
+func UploadTTL() time.Duration {
+	ttl, err := time.ParseDuration(Storage.Uploadttl)
+	if log.Check(log.WarnLevel, "Parsing upload session lifetime", err) || ttl <= 0 {
+		return 24 * time.Hour
+	}
+	return ttl
+}
+
+// FsckInterval returns interval of scheduled storage consistency check, zero means it is disabled
+func FsckInterval() time.Duration {
+	if Storage.Fsckinterval == "0" || len(Storage.Fsckinterval) == 0 {
+		return 0
+	}
+	interval, err := time.ParseDuration(Storage.Fsckinterval)
+	if log.Check(log.WarnLevel, "Parsing storage check interval", err) {
+		return 0
+	}
+	return interval
+}
+
+// TokenTTL returns lifetime of API tokens
+func TokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(Auth.Tokenttl)
+	if log.Check(log.WarnLevel, "Parsing token lifetime", err) || ttl <= 0 {
+		return time.Hour
+	}
+	return ttl
+}
+
+// ChallengeTTL returns time during which authentication challenge should be signed and exchanged for token
+func ChallengeTTL() time.Duration {
+	ttl, err := time.ParseDuration(Auth.Challengettl)
+	if log.Check(log.WarnLevel, "Parsing auth challenge lifetime", err) || ttl <= 0 {
+		return 10 * time.Minute
+	}
+	return ttl
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+)
+
+// Aliases bucket keeps named pointers of owners to their artifacts: Aliases/<owner>/<repo>/<alias> contains
+// current artifact ID and history of alias moves, where every entry is keyed by date and holds
+// new and previous artifact IDs and user who made the change.
+
+// Alias returns ID of artifact which owner's alias points to, or empty string if alias is unknown
+// or artifact is not in the repo or not owned by the owner anymore
+func Alias(owner, repo, name string) (id string) {
+	if len(owner) == 0 {
+		owner = "subutai"
+	}
+	owner = strings.ToLower(owner)
+	db.View(func(tx *bolt.Tx) error {
+		if b := aliasBucket(tx, owner, repo, name); b != nil {
+			id = string(b.Get([]byte("id")))
+		}
+		return nil
+	})
+	if len(id) == 0 || CheckRepo(owner, repo, id) == 0 {
+		return ""
+	}
+	return id
+}
+
+// Aliases returns all aliases of owner in repo with IDs of artifacts they point to
+func Aliases(owner, repo string) map[string]string {
+	list := make(map[string]string)
+	db.View(func(tx *bolt.Tx) error {
+		if b := aliasBucket(tx, owner, repo, ""); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				if a := b.Bucket(k); a != nil && a.Get([]byte("id")) != nil {
+					list[string(k)] = string(a.Get([]byte("id")))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return list
+}
+
+// SetAlias points owner's alias to artifact, creating alias if needed. Empty id removes the alias,
+// while its history is kept.
+func SetAlias(owner, repo, name, id, by string) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(aliases).CreateBucketIfNotExists([]byte(owner))
+		if err != nil {
+			return err
+		}
+		if b, err = b.CreateBucketIfNotExists([]byte(repo)); err != nil {
+			return err
+		}
+		if b, err = b.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+		previous := string(b.Get([]byte("id")))
+		if previous == id {
+			return nil
+		}
+		if len(id) == 0 {
+			b.Delete([]byte("id"))
+		} else {
+			b.Put([]byte("id"), []byte(id))
+		}
+
+		h, err := b.CreateBucketIfNotExists([]byte("history"))
+		if err != nil {
+			return err
+		}
+		now, _ := time.Now().MarshalText()
+		if h, err = h.CreateBucket(now); err != nil {
+			return err
+		}
+		h.Put([]byte("id"), []byte(id))
+		h.Put([]byte("previous"), []byte(previous))
+		h.Put([]byte("by"), []byte(by))
+		return nil
+	})
+	log.Check(log.WarnLevel, "Setting alias "+name+" of "+owner, err)
+}
+
+// AliasHistory returns moves of owner's alias from the oldest to the newest one
+func AliasHistory(owner, repo, name string) (list []map[string]string) {
+	db.View(func(tx *bolt.Tx) error {
+		if b := aliasBucket(tx, owner, repo, name); b != nil && b.Bucket([]byte("history")) != nil {
+			h := b.Bucket([]byte("history"))
+			h.ForEach(func(k, v []byte) error {
+				if e := h.Bucket(k); e != nil {
+					list = append(list, map[string]string{
+						"date":     string(k),
+						"id":       string(e.Get([]byte("id"))),
+						"previous": string(e.Get([]byte("previous"))),
+						"by":       string(e.Get([]byte("by"))),
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return list
+}
+
+// aliasBucket returns bucket of owner's alias, or bucket of all owner's aliases in repo if name is empty
+func aliasBucket(tx *bolt.Tx, owner, repo, name string) *bolt.Bucket {
+	b := tx.Bucket(aliases).Bucket([]byte(owner))
+	if b == nil {
+		return nil
+	}
+	if b = b.Bucket([]byte(repo)); b == nil || len(name) == 0 {
+		return b
+	}
+	return b.Bucket([]byte(name))
+}
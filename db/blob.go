@@ -0,0 +1,312 @@
+package db
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/gorjun/config"
+	"github.com/subutai-io/gorjun/storage"
+)
+
+// Blobs bucket keeps stored files by their sha256 sums. Every blob has storage key, size,
+// references of records which use it (refs/<owner>/<record id>) and amounts charged to owners' quota.
+// Blob is removed from storage when the last reference is gone. Blob of upload which record is not written yet
+// is pinned: its "pending" counter keeps it from removal by other uploads and deletions meanwhile.
+
+// pinTTL limits protection of blobs pinned by uploads which never finished
+const pinTTL = time.Hour
+
+// Blob returns storage key of blob with specified sha256 sum, or empty string if blob is unknown
+func Blob(sha256 string) (key string) {
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(blobs).Bucket([]byte(sha256)); b != nil {
+			key = string(b.Get([]byte("key")))
+		}
+		return nil
+	})
+	return key
+}
+
+// PinBlob pins known blob for upload of the same content and returns its storage key,
+// or empty string if blob is unknown
+func PinBlob(sha256 string) (key string) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(blobs).Bucket([]byte(sha256)); b != nil {
+			pin(b, 1)
+			key = string(b.Get([]byte("key")))
+		}
+		return nil
+	})
+	return key
+}
+
+// AddBlob registers just stored blob. It stays pinned until record about file is written or upload is dropped.
+func AddBlob(sha256, key string, size int64) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := newBlob(tx, []byte(sha256), key, size); b != nil {
+			pin(b, 1)
+		}
+		return nil
+	})
+}
+
+// DropBlob unpins blob of rejected upload and removes it, if it is not referenced by any record
+// and not pinned by other uploads
+func DropBlob(sha256 string) {
+	var key string
+	db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(blobs).Bucket([]byte(sha256)); b != nil {
+			pin(b, -1)
+			if k, _ := b.Bucket([]byte("refs")).Cursor().First(); k == nil && !pending(b) {
+				key = string(b.Get([]byte("key")))
+				return tx.Bucket(blobs).DeleteBucket([]byte(sha256))
+			}
+		}
+		return nil
+	})
+	if len(key) != 0 {
+		log.Check(log.WarnLevel, "Removing "+key+" from storage", storage.Delete(key))
+	}
+}
+
+// pin changes number of uploads which stored blob and have not written their records yet
+func pin(b *bolt.Bucket, delta int) {
+	n, _ := strconv.Atoi(string(b.Get([]byte("pending"))))
+	if n += delta; n < 0 {
+		n = 0
+	}
+	b.Put([]byte("pending"), []byte(strconv.Itoa(n)))
+	if delta > 0 {
+		now, _ := time.Now().MarshalText()
+		b.Put([]byte("pinned"), now)
+	}
+}
+
+// pending checks if blob is pinned by upload in progress
+func pending(b *bolt.Bucket) bool {
+	n, _ := strconv.Atoi(string(b.Get([]byte("pending"))))
+	date := new(time.Time)
+	date.UnmarshalText(b.Get([]byte("pinned")))
+	return n > 0 && time.Since(*date) < pinTTL
+}
+
+func newBlob(tx *bolt.Tx, sha256 []byte, key string, size int64) *bolt.Bucket {
+	if b := tx.Bucket(blobs).Bucket(sha256); b != nil {
+		return b
+	}
+	b, err := tx.Bucket(blobs).CreateBucket(sha256)
+	if log.Check(log.WarnLevel, "Creating blob record", err) {
+		return nil
+	}
+	b.Put([]byte("key"), []byte(key))
+	b.Put([]byte("size"), []byte(strconv.FormatInt(size, 10)))
+	b.CreateBucket([]byte("refs"))
+	b.CreateBucket([]byte("charged"))
+	return b
+}
+
+// recordSum returns sha256 sum of file described by record
+func recordSum(tx *bolt.Tx, id []byte) []byte {
+	if b := tx.Bucket(bucket).Bucket(id); b != nil {
+		if h := b.Bucket([]byte("hash")); h != nil && h.Get([]byte("sha256")) != nil {
+			return h.Get([]byte("sha256"))
+		}
+		return b.Get([]byte("SHA256"))
+	}
+	return nil
+}
+
+// attach adds reference of owner's record to blob and recalculates quota charges
+func attach(tx *bolt.Tx, sha256 []byte, key, id, owner string, size int64, apply bool) {
+	b := newBlob(tx, sha256, key, size)
+	if b == nil {
+		return
+	}
+	if o, err := b.Bucket([]byte("refs")).CreateBucketIfNotExists([]byte(owner)); err == nil && o.Get([]byte(id)) == nil {
+		now, _ := time.Now().MarshalText()
+		o.Put([]byte(id), now)
+	}
+	charge(tx, sha256, apply)
+}
+
+// detach removes references of record from blob, either of particular owner or of all owners if owner is empty.
+// It returns storage key of blob if no references left and blob should be removed.
+func detach(tx *bolt.Tx, sha256 []byte, id, owner string) (drop string) {
+	b := tx.Bucket(blobs).Bucket(sha256)
+	if b == nil {
+		return ""
+	}
+	refs := b.Bucket([]byte("refs"))
+	var owners [][]byte
+	refs.ForEach(func(k, v []byte) error {
+		if len(owner) == 0 || string(k) == owner {
+			owners = append(owners, k)
+		}
+		return nil
+	})
+	for _, k := range owners {
+		if o := refs.Bucket(k); o != nil {
+			o.Delete([]byte(id))
+			if first, _ := o.Cursor().First(); first == nil {
+				refs.DeleteBucket(k)
+			}
+		}
+	}
+	charge(tx, sha256, true)
+	if k, _ := refs.Cursor().First(); k == nil && !pending(b) {
+		drop = string(b.Get([]byte("key")))
+		tx.Bucket(blobs).DeleteBucket(sha256)
+	}
+	return drop
+}
+
+// charge distributes size of blob among quotas of its owners according to configured policy:
+// "full" charges every owner with whole size, "first" charges only the earliest owner and
+// "split" divides size equally between owners. Differences from previous charges are applied
+// to quota usage if apply is set.
+func charge(tx *bolt.Tx, sha256 []byte, apply bool) {
+	b := tx.Bucket(blobs).Bucket(sha256)
+	if b == nil {
+		return
+	}
+	size, _ := strconv.Atoi(string(b.Get([]byte("size"))))
+
+	type ref struct {
+		owner string
+		date  time.Time
+	}
+	var owners []ref
+	b.Bucket([]byte("refs")).ForEach(func(k, v []byte) error {
+		r := ref{owner: string(k)}
+		if o := b.Bucket([]byte("refs")).Bucket(k); o != nil {
+			o.ForEach(func(_, v []byte) error {
+				date := new(time.Time)
+				date.UnmarshalText(v)
+				if r.date.IsZero() || date.Before(r.date) {
+					r.date = *date
+				}
+				return nil
+			})
+		}
+		owners = append(owners, r)
+		return nil
+	})
+	sort.SliceStable(owners, func(i, j int) bool { return owners[i].date.Before(owners[j].date) })
+
+	want := make(map[string]int)
+	for i, r := range owners {
+		switch config.Storage.Sharedquota {
+		case "first":
+			if i == 0 {
+				want[r.owner] = size
+			}
+		case "split":
+			want[r.owner] = size / len(owners)
+			if i == 0 {
+				want[r.owner] += size % len(owners)
+			}
+		default:
+			want[r.owner] = size
+		}
+	}
+
+	charged, _ := b.CreateBucketIfNotExists([]byte("charged"))
+	old := make(map[string]int)
+	charged.ForEach(func(k, v []byte) error {
+		old[string(k)], _ = strconv.Atoi(string(v))
+		return nil
+	})
+	for owner, v := range old {
+		if _, ok := want[owner]; !ok {
+			if apply {
+				usage(tx, owner, -v)
+			}
+			charged.Delete([]byte(owner))
+		}
+	}
+	for owner, v := range want {
+		if apply && v != old[owner] {
+			usage(tx, owner, v-old[owner])
+		}
+		charged.Put([]byte(owner), []byte(strconv.Itoa(v)))
+	}
+}
+
+// unsizedBlobs returns sizes of stored files of records which do not keep their size, for migration of blob table.
+// Storage is not accessed under DB lock, so sizes are requested outside of migration transaction.
+func unsizedBlobs(db *bolt.DB) map[string]int64 {
+	sizes := make(map[string]int64)
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(blobs) != nil || tx.Bucket(bucket) == nil {
+			return nil
+		}
+		return tx.Bucket(bucket).ForEach(func(id, v []byte) error {
+			if b := tx.Bucket(bucket).Bucket(id); b != nil && len(recordSum(tx, id)) != 0 {
+				if _, err := strconv.ParseInt(string(b.Get([]byte("size"))), 10, 64); err != nil {
+					sizes[recordKey(tx, id)] = -1
+				}
+			}
+			return nil
+		})
+	})
+	for key := range sizes {
+		sizes[key] = storage.Size(key)
+	}
+	return sizes
+}
+
+// migrateBlobs fills blob table from existing records, keeping saved quota usage values untouched.
+// Sizes of files which are not kept in records are taken from sizes.
+func migrateBlobs(tx *bolt.Tx, sizes map[string]int64) {
+	tx.Bucket(bucket).ForEach(func(id, v []byte) error {
+		b := tx.Bucket(bucket).Bucket(id)
+		sha256 := recordSum(tx, id)
+		if b == nil || len(sha256) == 0 {
+			return nil
+		}
+		key := recordKey(tx, id)
+		size, err := strconv.ParseInt(string(b.Get([]byte("size"))), 10, 64)
+		if err != nil {
+			if s, ok := sizes[key]; ok {
+				size = s
+			} else {
+				size = -1
+			}
+		}
+		if size < 0 {
+			return nil
+		}
+		for _, owner := range recordOwners(b) {
+			attach(tx, sha256, key, string(id), owner, size, false)
+		}
+		return nil
+	})
+}
+
+// recordOwners returns list of users which have record in any repo
+func recordOwners(b *bolt.Bucket) (list []string) {
+	seen := make(map[string]bool)
+	if t := b.Bucket([]byte("type")); t != nil {
+		t.ForEach(func(repo, v []byte) error {
+			if r := t.Bucket(repo); r != nil {
+				r.ForEach(func(k, v []byte) error {
+					if !seen[string(k)] {
+						seen[string(k)] = true
+						list = append(list, string(k))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	} else if o := b.Bucket([]byte("owner")); o != nil {
+		o.ForEach(func(k, v []byte) error {
+			list = append(list, string(k))
+			return nil
+		})
+	}
+	return list
+}
@@ -0,0 +1,21 @@
+package db
+
+import "testing"
+
+func TestPinnedBlob(t *testing.T) {
+	AddBlob("pinned-blob", "pinned-key", 10)
+	if key := PinBlob("pinned-blob"); key != "pinned-key" {
+		t.Fatalf("PinBlob returned %q, expected pinned-key", key)
+	}
+	DropBlob("pinned-blob")
+	if len(Blob("pinned-blob")) == 0 {
+		t.Errorf("Blob pinned by another upload is dropped")
+	}
+	DropBlob("pinned-blob")
+	if len(Blob("pinned-blob")) != 0 {
+		t.Errorf("Blob without references and pins is not dropped")
+	}
+	if key := PinBlob("pinned-blob"); key != "" {
+		t.Errorf("PinBlob of unknown blob returned %q", key)
+	}
+}
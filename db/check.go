@@ -0,0 +1,245 @@
+package db
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/gorjun/storage"
+)
+
+// Records returns IDs of all records about files
+func Records() (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			if v == nil {
+				list = append(list, string(k))
+			}
+			return nil
+		})
+	})
+	return list
+}
+
+// RecordBlob returns storage key and sha256 sum of file described by record
+func RecordBlob(id string) (key, sha256 string) {
+	db.View(func(tx *bolt.Tx) error {
+		key, sha256 = recordKey(tx, []byte(id)), string(recordSum(tx, []byte(id)))
+		return nil
+	})
+	return key, sha256
+}
+
+// recordKey returns storage key of file described by record: its md5 sum or record ID itself
+func recordKey(tx *bolt.Tx, id []byte) string {
+	if b := tx.Bucket(bucket).Bucket(id); b != nil {
+		if h := b.Bucket([]byte("hash")); h != nil && h.Get([]byte("md5")) != nil {
+			return string(h.Get([]byte("md5")))
+		}
+	}
+	return string(id)
+}
+
+// StorageKeys returns set of storage keys known to DB, either by blob table or by records
+func StorageKeys() map[string]bool {
+	keys := make(map[string]bool)
+	db.View(func(tx *bolt.Tx) error {
+		tx.Bucket(blobs).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(blobs).Bucket(k); b != nil {
+				keys[string(b.Get([]byte("key")))] = true
+			}
+			return nil
+		})
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			keys[recordKey(tx, k)] = true
+			return nil
+		})
+	})
+	return keys
+}
+
+// Purge removes record about file for all its owners, together with index entries.
+// Stored file is removed if no other records reference it.
+func Purge(id string) {
+	var drop string
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		name := bytes.ToLower(b.Get([]byte("name")))
+		owners := recordOwners(b)
+		if o := b.Bucket([]byte("owner")); o != nil {
+			o.ForEach(func(k, v []byte) error {
+				owners = append(owners, string(k))
+				return nil
+			})
+		}
+		for _, owner := range owners {
+			if u := tx.Bucket(users).Bucket([]byte(owner)); u != nil {
+				if f := u.Bucket([]byte("files")); f != nil {
+					f.Delete([]byte(id))
+				}
+			}
+		}
+		if s := tx.Bucket(search).Bucket(name); s != nil {
+			deleteValue(s, []byte(id))
+		}
+		if t := b.Bucket([]byte("tags")); t != nil {
+			t.ForEach(func(k, v []byte) error {
+				if s := tx.Bucket(tags).Bucket(k); s != nil {
+					s.Delete([]byte(id))
+				}
+				return nil
+			})
+		}
+		sha256 := append([]byte(nil), recordSum(tx, []byte(id))...)
+		unindexRecord(tx, []byte(id))
+		tx.Bucket(bucket).DeleteBucket([]byte(id))
+		if len(sha256) != 0 {
+			drop = detach(tx, sha256, id, "")
+		}
+		return nil
+	})
+	if len(drop) != 0 {
+		log.Check(log.WarnLevel, "Removing "+drop+" from storage", storage.Delete(drop))
+	}
+}
+
+// deleteValue removes all keys of bucket which have specified value
+func deleteValue(b *bolt.Bucket, value []byte) {
+	var list [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if bytes.Equal(v, value) {
+			list = append(list, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, k := range list {
+		b.Delete(k)
+	}
+}
+
+// CheckIndex looks for search and tag index entries pointing to missing records or records with different
+// name or tags, and for blob references of missing records. Found entries are removed if repair is set.
+func CheckIndex(repair bool) (issues []string) {
+	var drop []string
+	update := db.View
+	if repair {
+		update = db.Update
+	}
+	update(func(tx *bolt.Tx) error {
+		type entry struct{ bucket, key []byte }
+		var stale []entry
+		var refs [][2]string
+
+		tx.Bucket(search).ForEach(func(name, v []byte) error {
+			if s := tx.Bucket(search).Bucket(name); s != nil {
+				s.ForEach(func(k, id []byte) error {
+					r := tx.Bucket(bucket).Bucket(id)
+					if r == nil || !bytes.Equal(bytes.ToLower(r.Get([]byte("name"))), name) {
+						issues = append(issues, "Search index entry \""+string(name)+"\" points to missing or changed record "+string(id))
+						stale = append(stale, entry{append([]byte(nil), name...), append([]byte(nil), k...)})
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		for _, e := range stale {
+			if repair {
+				tx.Bucket(search).Bucket(e.bucket).Delete(e.key)
+			}
+		}
+
+		for _, ix := range [][]byte{index, suffixes} {
+			stale = stale[:0]
+			tx.Bucket(ix).ForEach(func(term, v []byte) error {
+				if t := tx.Bucket(ix).Bucket(term); t != nil {
+					t.ForEach(func(id, v []byte) error {
+						if tx.Bucket(bucket).Bucket(id) == nil {
+							issues = append(issues, "Search term \""+string(term)+"\" points to missing record "+string(id))
+							stale = append(stale, entry{append([]byte(nil), term...), append([]byte(nil), id...)})
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			for _, e := range stale {
+				if repair {
+					tx.Bucket(ix).Bucket(e.bucket).Delete(e.key)
+				}
+			}
+		}
+
+		stale = stale[:0]
+		tx.Bucket(tags).ForEach(func(tag, v []byte) error {
+			if t := tx.Bucket(tags).Bucket(tag); t != nil {
+				t.ForEach(func(id, v []byte) error {
+					r := tx.Bucket(bucket).Bucket(id)
+					if r == nil || r.Bucket([]byte("tags")) == nil || r.Bucket([]byte("tags")).Get(tag) == nil {
+						issues = append(issues, "Tag index entry \""+string(tag)+"\" points to missing or changed record "+string(id))
+						stale = append(stale, entry{append([]byte(nil), tag...), append([]byte(nil), id...)})
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		for _, e := range stale {
+			if repair {
+				tx.Bucket(tags).Bucket(e.bucket).Delete(e.key)
+			}
+		}
+
+		tx.Bucket(blobs).ForEach(func(sha256, v []byte) error {
+			if b := tx.Bucket(blobs).Bucket(sha256); b != nil {
+				b.Bucket([]byte("refs")).ForEach(func(owner, v []byte) error {
+					if o := b.Bucket([]byte("refs")).Bucket(owner); o != nil {
+						o.ForEach(func(id, v []byte) error {
+							if tx.Bucket(bucket).Bucket(id) == nil {
+								issues = append(issues, "Blob "+string(b.Get([]byte("key")))+" is referenced by missing record "+string(id))
+								refs = append(refs, [2]string{string(sha256), string(id)})
+							}
+							return nil
+						})
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		for _, r := range refs {
+			if repair {
+				if key := detach(tx, []byte(r[0]), r[1], ""); len(key) != 0 {
+					drop = append(drop, key)
+				}
+			}
+		}
+		return nil
+	})
+	for _, key := range drop {
+		log.Check(log.WarnLevel, "Removing "+key+" from storage", storage.Delete(key))
+	}
+	return issues
+}
+
+// QuotaUsageDrift returns users which saved quota usage differs from real one, with saved and real values
+func QuotaUsageDrift() map[string][2]int {
+	drift := make(map[string][2]int)
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(users).ForEach(func(k, v []byte) error {
+			if c := tx.Bucket(users).Bucket(k); c != nil {
+				real := countTotal(tx, string(k))
+				if s := c.Get([]byte("stored")); s == nil && real != 0 || s != nil && string(s) != strconv.Itoa(real) {
+					stored, _ := strconv.Atoi(string(s))
+					drift[string(k)] = [2]int{stored, real}
+				}
+			}
+			return nil
+		})
+	})
+	return drift
+}
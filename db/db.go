@@ -2,7 +2,6 @@ package db
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,16 +12,25 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/subutai-io/agent/log"
 	"github.com/subutai-io/gorjun/config"
+	"github.com/subutai-io/gorjun/storage"
 )
 
 var (
-	bucket = []byte("MyBucket")
-	search = []byte("SearchIndex")
-	users  = []byte("Users")
-	tokens = []byte("Tokens")
-	authID = []byte("AuthID")
-	tags   = []byte("Tags")
-	db     = initDB()
+	bucket     = []byte("MyBucket")
+	search     = []byte("SearchIndex")
+	users      = []byte("Users")
+	tokens     = []byte("Tokens")
+	authID     = []byte("AuthID")
+	tags       = []byte("Tags")
+	uploads    = []byte("Uploads")
+	blobs      = []byte("Blobs")
+	index      = []byte("Index")
+	suffixes   = []byte("Suffixes")
+	aliases    = []byte("Aliases")
+	publishers = []byte("Publishers")
+	deployKeys = []byte("DeployKeys")
+	roles      = []byte("Roles")
+	db         = initDB()
 )
 
 func initDB() *bolt.DB {
@@ -30,11 +38,32 @@ func initDB() *bolt.DB {
 	os.MkdirAll(config.Storage.Path, 0755)
 	db, err := bolt.Open(config.DB.Path, 0600, &bolt.Options{Timeout: 3 * time.Second})
 	log.Check(log.FatalLevel, "Opening DB: "+config.DB.Path, err)
+	sizes := unsizedBlobs(db)
 	err = db.Update(func(tx *bolt.Tx) error {
-		for _, b := range [][]byte{bucket, search, users, tokens, authID, tags} {
+		migrate, reindex, seed := tx.Bucket(blobs) == nil, tx.Bucket(suffixes) == nil, tx.Bucket(publishers) == nil
+		assign := tx.Bucket(roles) == nil
+		for _, b := range [][]byte{bucket, search, users, tokens, authID, tags, uploads, blobs, index, suffixes, aliases, publishers, deployKeys, roles} {
 			_, err := tx.CreateBucketIfNotExists(b)
 			log.Check(log.FatalLevel, "Creating bucket: "+string(b), err)
 		}
+		if migrate {
+			log.Info("Building blob table from existing records")
+			migrateBlobs(tx, sizes)
+		}
+		if reindex {
+			log.Info("Building search index of existing records")
+			migrateIndex(tx)
+		}
+		if seed {
+			// Owners which were treated as verified before the list became configurable
+			for _, name := range []string{"subutai", "jenkins", "docker"} {
+				addPublisher(tx, name, "")
+			}
+		}
+		if assign {
+			log.Info("Assigning roles to existing users")
+			migrateRoles(tx)
+		}
 		return nil
 	})
 	log.Check(log.FatalLevel, "Finishing update transaction", err)
@@ -47,6 +76,21 @@ func Write(owner, key, value string, options ...map[string]string) {
 	if len(owner) == 0 {
 		owner = "subutai"
 	}
+	// Size of stored file is requested before transaction, so storage is not accessed under DB lock
+	var blob string
+	size := int64(-1)
+	db.View(func(tx *bolt.Tx) error {
+		blob = recordKey(tx, []byte(key))
+		return nil
+	})
+	for i := range options {
+		if v, ok := options[i]["md5"]; ok {
+			blob = v
+		}
+	}
+	if fi, err := storage.Stat(blob); err == nil {
+		size = fi.Size
+	}
 	err := db.Update(func(tx *bolt.Tx) error {
 		now, _ := time.Now().MarshalText()
 
@@ -86,11 +130,8 @@ func Write(owner, key, value string, options ...map[string]string) {
 					case "md5", "sha256":
 						if c, err := b.CreateBucketIfNotExists([]byte("hash")); err == nil {
 							c.Put([]byte(k), []byte(v))
-							// Getting file size
-							if f, err := os.Open(config.Storage.Path + v); err == nil {
-								fi, _ := f.Stat()
-								f.Close()
-								b.Put([]byte("size"), []byte(fmt.Sprint(fi.Size())))
+							if size >= 0 {
+								b.Put([]byte("size"), []byte(fmt.Sprint(size)))
 							}
 						}
 					case "tags":
@@ -117,16 +158,29 @@ func Write(owner, key, value string, options ...map[string]string) {
 				if b, _ = b.CreateBucketIfNotExists([]byte(owner)); b != nil {
 				}
 			}
+
+			// Referencing stored blob, which charges owner's quota, and unpinning it as upload is finished
+			if sha256 := recordSum(tx, []byte(key)); len(sha256) != 0 {
+				if size >= 0 {
+					attach(tx, sha256, recordKey(tx, []byte(key)), key, owner, size, true)
+				}
+				if b := tx.Bucket(blobs).Bucket(sha256); b != nil {
+					pin(b, -1)
+				}
+			}
+			indexRecord(tx, []byte(key))
 		}
 		return nil
 	})
 	log.Check(log.WarnLevel, "Writing data to db", err)
 }
 
-// Delete removes record about file from DB
+// Delete removes record about file from DB. Stored file is removed when no records reference it.
 func Delete(owner, repo, key string) (total int) {
+	var drop string
 	db.Update(func(tx *bolt.Tx) error {
 		var filename []byte
+		sha256 := append([]byte(nil), recordSum(tx, []byte(key))...)
 
 		owned := CheckRepo(owner, "", key)
 		md5, _ := Hash(key)
@@ -150,6 +204,9 @@ func Delete(owner, repo, key string) (total int) {
 			if b := b.Bucket([]byte("owner")); owned == 1 && b != nil {
 				b.Delete([]byte(owner))
 			}
+			if owned == 1 && len(sha256) != 0 {
+				drop = detach(tx, sha256, key, owner)
+			}
 		}
 
 		// Deleting file association with user
@@ -164,12 +221,7 @@ func Delete(owner, repo, key string) (total int) {
 		if total == 1 || key != md5 {
 			// Deleting search index
 			if b := tx.Bucket(search).Bucket(bytes.ToLower(filename)); b != nil {
-				b.ForEach(func(k, v []byte) error {
-					if string(v) == key {
-						b.Delete(k)
-					}
-					return nil
-				})
+				deleteValue(b, []byte(key))
 			}
 
 			for _, tag := range FileField(key, "tags") {
@@ -179,10 +231,20 @@ func Delete(owner, repo, key string) (total int) {
 			}
 
 			// Removing file from DB
+			unindexRecord(tx, []byte(key))
 			tx.Bucket(bucket).DeleteBucket([]byte(key))
+			if len(sha256) != 0 && len(drop) == 0 {
+				drop = detach(tx, sha256, key, "")
+			}
+		} else {
+			indexRecord(tx, []byte(key))
 		}
 		return nil
 	})
+	if len(drop) != 0 {
+		log.Info("Removing " + drop + " from storage")
+		log.Check(log.WarnLevel, "Removing "+drop+" from storage", storage.Delete(drop))
+	}
 	return total - 1
 }
 
@@ -240,31 +302,6 @@ func Close() {
 	db.Close()
 }
 
-func Search(query string) (list []string) {
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(search)
-		b.ForEach(func(k, v []byte) error {
-			if strings.Contains(strings.ToLower(string(k)), strings.ToLower(query)) {
-				// for k, _ := c.Seek([]byte(query)); len(k) > 0 && bytes.HasPrefix(k, []byte(query)); k, _ = c.Next() {
-				//Shitty search index contains lots of outdated and invalid records and we must return all of them. Need to fix it.
-				b.Bucket(k).ForEach(func(kk, vv []byte) error {
-					for _, l := range list {
-						if l == string(vv) {
-							return nil
-						}
-					}
-					list = append(list, string(vv))
-					return nil
-				})
-				// _, kk := b.Bucket(k).Cursor().First()
-			}
-			return nil
-		})
-		return nil
-	})
-	return
-}
-
 func LastHash(name, t string) (hash string) {
 	db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(search).Bucket([]byte(strings.ToLower(name))); b != nil {
@@ -283,12 +320,21 @@ func LastHash(name, t string) (hash string) {
 
 func RegisterUser(name, key []byte) {
 	db.Update(func(tx *bolt.Tx) error {
+		if orgBucket(tx, string(name)) != nil {
+			log.Warn("Can not register user " + string(name) + ", the name belongs to organization")
+			return nil
+		}
 		b, err := tx.Bucket(users).CreateBucketIfNotExists([]byte(strings.ToLower(string(name))))
 		if !log.Check(log.WarnLevel, "Registering user "+string(name), err) {
 			b.Put([]byte("key"), key)
 			if b, err := b.CreateBucketIfNotExists([]byte("keys")); err == nil {
 				b.Put(key, nil)
 			}
+			if tx.Bucket(roles).Bucket([]byte(strings.ToLower(string(name)))) == nil {
+				for _, role := range defaultRoles {
+					grantRole(tx, string(name), role)
+				}
+			}
 		}
 		return err
 	})
@@ -321,53 +367,127 @@ func UserKey(name string) (key string) {
 	return key
 }
 
-func SaveToken(name, token string) {
+// SaveUpload creates record about chunked upload session of the file with expected size
+func SaveUpload(id, owner, name string, size int64) {
 	db.Update(func(tx *bolt.Tx) error {
-		if b, _ := tx.Bucket(tokens).CreateBucketIfNotExists([]byte(token)); b != nil {
+		now, _ := time.Now().MarshalText()
+		if b, err := tx.Bucket(uploads).CreateBucket([]byte(id)); err == nil {
+			b.Put([]byte("owner"), []byte(owner))
 			b.Put([]byte("name"), []byte(name))
-			now, _ := time.Now().MarshalText()
+			b.Put([]byte("size"), []byte(strconv.FormatInt(size, 10)))
 			b.Put([]byte("date"), now)
+			b.CreateBucket([]byte("chunks"))
 		}
 		return nil
 	})
 }
 
-func CheckToken(token string) (name string) {
-	token = fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+// UploadChunk stores offset and length of received chunk of upload session and refreshes session date
+func UploadChunk(id, chunk string, offset, length int64) {
+	db.Update(func(tx *bolt.Tx) error {
+		now, _ := time.Now().MarshalText()
+		if b := tx.Bucket(uploads).Bucket([]byte(id)); b != nil {
+			b.Put([]byte("date"), now)
+			if c := b.Bucket([]byte("chunks")); c != nil {
+				c.Put([]byte(chunk), []byte(strconv.FormatInt(offset, 10)+":"+strconv.FormatInt(length, 10)))
+			}
+		}
+		return nil
+	})
+}
 
+// UploadInfo returns properties of upload session and map of received chunks in "offset:length" form
+func UploadInfo(id string) (info map[string]string, chunks map[string]string) {
+	info, chunks = make(map[string]string), make(map[string]string)
 	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(tokens).Bucket([]byte(token)); b != nil {
-			date := new(time.Time)
-			date.UnmarshalText(b.Get([]byte("date")))
-			if date.Add(time.Minute * 60).Before(time.Now()) {
+		if b := tx.Bucket(uploads).Bucket([]byte(id)); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				if v != nil {
+					info[string(k)] = string(v)
+				}
 				return nil
-			}
-			if value := b.Get([]byte("name")); value != nil {
-				name = string(value)
+			})
+			if c := b.Bucket([]byte("chunks")); c != nil {
+				c.ForEach(func(k, v []byte) error {
+					chunks[string(k)] = string(v)
+					return nil
+				})
 			}
 		}
 		return nil
 	})
-	return name
+	return info, chunks
 }
 
-func SaveAuthID(name, token string) {
+// TouchUpload refreshes date of upload session, so it does not expire while chunk is written.
+// It returns false if session does not exist.
+func TouchUpload(id string) (found bool) {
 	db.Update(func(tx *bolt.Tx) error {
-		tx.Bucket(authID).Put([]byte(token), []byte(name))
+		now, _ := time.Now().MarshalText()
+		if b := tx.Bucket(uploads).Bucket([]byte(id)); b != nil {
+			found = b.Put([]byte("date"), now) == nil
+		}
 		return nil
 	})
+	return found
 }
 
-func CheckAuthID(token string) (name string) {
+// DeleteUpload removes record about upload session if it was not active since specified time, zero time
+// removes session in any case. It returns true only to the caller which actually removed the session,
+// so quota reserved for it is released once.
+func DeleteUpload(id string, before time.Time) (deleted bool) {
 	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(authID)
-		if value := b.Get([]byte(token)); value != nil {
-			name = string(value)
-			b.Delete([]byte(token))
+		b := tx.Bucket(uploads).Bucket([]byte(id))
+		if b == nil {
+			return nil
 		}
+		if !before.IsZero() {
+			date := new(time.Time)
+			date.UnmarshalText(b.Get([]byte("date")))
+			if !date.Before(before) {
+				return nil
+			}
+		}
+		deleted = tx.Bucket(uploads).DeleteBucket([]byte(id)) == nil
 		return nil
 	})
-	return name
+	return deleted
+}
+
+// Uploads returns list of upload sessions which were not active since specified time
+func Uploads(before time.Time) (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploads).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(uploads).Bucket(k); b != nil {
+				date := new(time.Time)
+				date.UnmarshalText(b.Get([]byte("date")))
+				if date.Before(before) {
+					list = append(list, string(k))
+				}
+			}
+			return nil
+		})
+	})
+	return list
+}
+
+// Items returns list of IDs of all artifacts stored in specified repo
+func Items(repo string) (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(bucket).Bucket(k); b != nil {
+				if t := b.Bucket([]byte("type")); t != nil {
+					if t := t.Bucket([]byte(repo)); t != nil {
+						if owner, _ := t.Cursor().First(); owner != nil {
+							list = append(list, string(k))
+						}
+					}
+				}
+			}
+			return nil
+		})
+	})
+	return list
 }
 
 // FileField provides list of file properties
@@ -476,20 +596,22 @@ func UnshareWith(hash, owner, user string) {
 	})
 }
 
-// CheckShare returns true if user has access to file, otherwise - false
+// CheckShare returns true if user has access to file, otherwise - false.
+// Files owned by or shared with organization are accessible for all its members.
 func CheckShare(hash, user string) (shared bool) {
 	// log.Warn("hash: " + hash + ", user: " + user)
 	db.View(func(tx *bolt.Tx) error {
+		names := append([]string{user}, userOrgs(tx, user)...)
 		if b := tx.Bucket(bucket).Bucket([]byte(hash)); b != nil {
 			if b := b.Bucket([]byte("scope")); b != nil {
 				b.ForEach(func(k, v []byte) error {
 					// log.Warn("Owner: " + string(k))
-					if strings.EqualFold(string(k), user) {
+					if inFold(string(k), names) {
 						shared = true
 					} else if b := b.Bucket(k); b != nil {
 						b.ForEach(func(k1, v1 []byte) error {
 							// log.Warn("+++" + string(k1))
-							if strings.EqualFold(string(k1), user) {
+							if inFold(string(k1), names) {
 								shared = true
 							}
 							return nil
@@ -504,6 +626,15 @@ func CheckShare(hash, user string) (shared bool) {
 	return
 }
 
+func inFold(str string, list []string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, str) {
+			return true
+		}
+	}
+	return false
+}
+
 // Public returns true if file is publicly accessible
 func Public(hash string) (public bool) {
 	db.View(func(tx *bolt.Tx) error {
@@ -527,42 +658,69 @@ func Public(hash string) (public bool) {
 	return
 }
 
-// countTotal counts and sets user's total quota usage
-func countTotal(user string) (total int) {
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(users).Bucket([]byte(user)); b != nil {
-			if c := b.Bucket([]byte("files")); c != nil {
-				c.ForEach(func(k, v []byte) error {
-					tmp, _ := strconv.Atoi(Info(string(k))["size"])
-					total += tmp
-					return nil
-				})
-			}
+// countTotal counts user's total quota usage according to charges of stored blobs
+func countTotal(tx *bolt.Tx, user string) (total int) {
+	tx.Bucket(blobs).ForEach(func(k, v []byte) error {
+		if c := tx.Bucket(blobs).Bucket(k).Bucket([]byte("charged")); c != nil {
+			tmp, _ := strconv.Atoi(string(c.Get([]byte(user))))
+			total += tmp
 		}
 		return nil
 	})
 	return
 }
 
+// usage changes saved quota usage of user within transaction
+func usage(tx *bolt.Tx, user string, value int) {
+	var stored int
+	if b := tx.Bucket(users).Bucket([]byte(user)); b != nil {
+		if s := b.Get([]byte("stored")); s != nil {
+			stored, _ = strconv.Atoi(string(s))
+		} else {
+			stored = countTotal(tx, user)
+		}
+		b.Put([]byte("stored"), []byte(strconv.Itoa(stored+value)))
+	}
+}
+
 // QuotaLeft returns user's quota left space
-func QuotaLeft(user string) int {
-	var quota, stored int
+func QuotaLeft(user string) (left int) {
 	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(users).Bucket([]byte(user)); b != nil {
-			if q := b.Get([]byte("quota")); q != nil {
-				quota, _ = strconv.Atoi(string(q))
-			} else {
-				quota = config.DefaultQuota()
-			}
-			if s := b.Get([]byte("stored")); s != nil {
-				stored, _ = strconv.Atoi(string(s))
-			} else {
-				stored = countTotal(user)
-				b.Put([]byte("stored"), []byte(strconv.Itoa(stored)))
-			}
+		left = quotaLeft(tx, user)
+		return nil
+	})
+	return left
+}
+
+// ReserveQuota adds size of file which is being received to user's quota usage if quota allows it.
+// Check and reservation are done at once, so parallel uploads can not exceed quota together.
+func ReserveQuota(user string, size int64) (reserved bool) {
+	db.Update(func(tx *bolt.Tx) error {
+		if left := quotaLeft(tx, user); left == -1 || size < int64(left) {
+			usage(tx, user, int(size))
+			reserved = true
 		}
 		return nil
 	})
+	return reserved
+}
+
+// quotaLeft returns free space of user's quota in bytes, -1 means unlimited quota
+func quotaLeft(tx *bolt.Tx, user string) int {
+	var quota, stored int
+	if b := tx.Bucket(users).Bucket([]byte(user)); b != nil {
+		if q := b.Get([]byte("quota")); q != nil {
+			quota, _ = strconv.Atoi(string(q))
+		} else {
+			quota = config.DefaultQuota()
+		}
+		if s := b.Get([]byte("stored")); s != nil {
+			stored, _ = strconv.Atoi(string(s))
+		} else {
+			stored = countTotal(tx, user)
+			b.Put([]byte("stored"), []byte(strconv.Itoa(stored)))
+		}
+	}
 	if quota == -1 {
 		return -1
 	} else if quota <= stored {
@@ -573,16 +731,8 @@ func QuotaLeft(user string) int {
 
 // QuotaUsageSet accepts size of added/removed file and updates quota usage for user
 func QuotaUsageSet(user string, value int) {
-	var stored int
 	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(users).Bucket([]byte(user)); b != nil {
-			if s := b.Get([]byte("stored")); s != nil {
-				stored, _ = strconv.Atoi(string(s))
-			} else {
-				stored = countTotal(user)
-			}
-			b.Put([]byte("stored"), []byte(strconv.Itoa(stored+value)))
-		}
+		usage(tx, user, value)
 		return nil
 	})
 }
@@ -612,24 +762,18 @@ func QuotaSet(user, quota string) {
 	})
 }
 
-// QuotaUsageCorrect updates saved values of quota usage according to file index table
+// QuotaUsageCorrect updates saved values of quota usage according to charges of stored blobs
 func QuotaUsageCorrect() {
-	db.Update(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(users); b != nil {
-			b.ForEach(func(k, v []byte) error {
-				if c := b.Bucket(k); c != nil {
-					rVal := countTotal(string(k))
-					if sVal := c.Get([]byte("stored")); sVal == nil && rVal != 0 || sVal != nil && string(sVal) != strconv.Itoa(rVal) {
-						log.Info("Correcting quota usage for user " + string(k))
-						log.Info("Stored value: " + string(sVal) + ", real value: " + strconv.Itoa(rVal))
-						c.Put([]byte("stored"), []byte(strconv.Itoa(rVal)))
-					}
-				}
-				return nil
-			})
-		}
-		return nil
-	})
+	for user, v := range QuotaUsageDrift() {
+		log.Info("Correcting quota usage for user " + user)
+		log.Info("Stored value: " + strconv.Itoa(v[0]) + ", real value: " + strconv.Itoa(v[1]))
+		db.Update(func(tx *bolt.Tx) error {
+			if b := tx.Bucket(users).Bucket([]byte(user)); b != nil {
+				b.Put([]byte("stored"), []byte(strconv.Itoa(v[1])))
+			}
+			return nil
+		})
+	}
 }
 
 // QuotaUsageGet returns value of used disk quota
@@ -639,7 +783,7 @@ func QuotaUsageGet(user string) (stored int) {
 			if s := b.Get([]byte("stored")); s != nil {
 				stored, _ = strconv.Atoi(string(s))
 			} else {
-				stored = countTotal(user)
+				stored = countTotal(tx, user)
 				b.Put([]byte("stored"), []byte(strconv.Itoa(stored)))
 			}
 		}
@@ -728,6 +872,7 @@ func RemoveTags(key, list string) error {
 					log.Check(log.DebugLevel, "Removing tag "+string(tag)+" from file information", t.Delete([]byte(key)))
 				}
 			}
+			indexRecord(tx, []byte(key))
 		}
 		return nil
 	})
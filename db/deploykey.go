@@ -0,0 +1,107 @@
+package db
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// DeployKeys bucket keeps long-lived secrets of users for automated uploads and deletions. Keys are stored
+// by sha256 hashes of secrets and have name unique for owner, allowed repos and artifact name patterns
+// (empty lists allow everything), creation date and date of the last use.
+
+// SaveDeployKey saves named deploy key of owner. It returns false if owner already has key with this name.
+func SaveDeployKey(owner, name, secret string, repos, patterns []string) (saved bool) {
+	db.Update(func(tx *bolt.Tx) error {
+		if deployKeyID(tx, owner, name) != nil {
+			return nil
+		}
+		b, err := tx.Bucket(deployKeys).CreateBucket([]byte(fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))))
+		if err != nil {
+			return err
+		}
+		now, _ := time.Now().MarshalText()
+		b.Put([]byte("owner"), []byte(owner))
+		b.Put([]byte("name"), []byte(name))
+		b.Put([]byte("repos"), []byte(strings.Join(repos, ",")))
+		b.Put([]byte("patterns"), []byte(strings.Join(patterns, ",")))
+		b.Put([]byte("date"), now)
+		saved = true
+		return nil
+	})
+	return saved
+}
+
+// DeployKey returns properties of deploy key by its secret, or nil if key is unknown
+func DeployKey(secret string) (key map[string]string) {
+	if len(secret) == 0 {
+		return nil
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(deployKeys).Bucket([]byte(fmt.Sprintf("%x", sha256.Sum256([]byte(secret))))); b != nil {
+			key = deployKeyInfo(b)
+		}
+		return nil
+	})
+	return key
+}
+
+// DeployKeyUsed updates date of the last use of deploy key
+func DeployKeyUsed(secret string) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(deployKeys).Bucket([]byte(fmt.Sprintf("%x", sha256.Sum256([]byte(secret))))); b != nil {
+			now, _ := time.Now().MarshalText()
+			b.Put([]byte("used"), now)
+		}
+		return nil
+	})
+}
+
+// DeployKeys returns deploy keys of owner
+func DeployKeys(owner string) (list []map[string]string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deployKeys).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(deployKeys).Bucket(k); b != nil && string(b.Get([]byte("owner"))) == owner {
+				list = append(list, deployKeyInfo(b))
+			}
+			return nil
+		})
+	})
+	return list
+}
+
+// RemoveDeployKey removes named deploy key of owner
+func RemoveDeployKey(owner, name string) (removed bool) {
+	db.Update(func(tx *bolt.Tx) error {
+		if id := deployKeyID(tx, owner, name); id != nil {
+			removed = tx.Bucket(deployKeys).DeleteBucket(id) == nil
+		}
+		return nil
+	})
+	return removed
+}
+
+// deployKeyID returns hash of owner's deploy key with specified name
+func deployKeyID(tx *bolt.Tx, owner, name string) (id []byte) {
+	tx.Bucket(deployKeys).ForEach(func(k, v []byte) error {
+		if b := tx.Bucket(deployKeys).Bucket(k); b != nil && string(b.Get([]byte("owner"))) == owner && string(b.Get([]byte("name"))) == name {
+			id = append([]byte(nil), k...)
+		}
+		return nil
+	})
+	return id
+}
+
+func deployKeyInfo(b *bolt.Bucket) map[string]string {
+	return map[string]string{
+		"owner":    string(b.Get([]byte("owner"))),
+		"name":     string(b.Get([]byte("name"))),
+		"repos":    string(b.Get([]byte("repos"))),
+		"patterns": string(b.Get([]byte("patterns"))),
+		"date":     string(b.Get([]byte("date"))),
+		"used":     string(b.Get([]byte("used"))),
+	}
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+)
+
+// Index bucket is an inverted index of records: every term has bucket with IDs of records containing it
+// and weights of the term in these records. Terms of record are also kept in its "terms" bucket,
+// so they can be removed when the record changes. Suffixes bucket is built the same way from proper suffixes
+// of terms, so words found inside terms are looked up with prefix seek as well as words at start of terms.
+
+// weights defines importance of record fields for search ranking
+var weights = map[string]int{
+	"name":        8,
+	"Package":     8,
+	"Source":      6,
+	"tags":        4,
+	"owner":       3,
+	"version":     2,
+	"Version":     2,
+	"Description": 1,
+}
+
+// splitWords splits text into lowercased words
+func splitWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// recordTerms returns terms of record fields with their weights. Whole field values are indexed
+// as well as separate words, and match of whole value weighs more.
+func recordTerms(b *bolt.Bucket) map[string]int {
+	list := make(map[string]int)
+	add := func(value string, weight int) {
+		if value = strings.ToLower(strings.TrimSpace(value)); len(value) == 0 {
+			return
+		}
+		for _, t := range splitWords(value) {
+			list[t] += weight
+		}
+		if len(value) <= 128 {
+			list[value] += weight
+		}
+	}
+	for field, weight := range weights {
+		switch field {
+		case "tags":
+			if t := b.Bucket([]byte("tags")); t != nil {
+				t.ForEach(func(k, v []byte) error {
+					add(string(k), weight)
+					return nil
+				})
+			}
+		case "owner":
+			for _, owner := range recordOwners(b) {
+				add(owner, weight)
+			}
+		default:
+			add(string(b.Get([]byte(field))), weight)
+		}
+	}
+	return list
+}
+
+// indexRecord updates search index entries of record according to its current fields
+func indexRecord(tx *bolt.Tx, id []byte) {
+	unindexRecord(tx, id)
+	b := tx.Bucket(bucket).Bucket(id)
+	if b == nil {
+		return
+	}
+	t, err := b.CreateBucketIfNotExists([]byte("terms"))
+	if err != nil {
+		return
+	}
+	for term, weight := range recordTerms(b) {
+		if i, err := tx.Bucket(index).CreateBucketIfNotExists([]byte(term)); err == nil {
+			i.Put(id, []byte(strconv.Itoa(weight)))
+			t.Put([]byte(term), nil)
+		}
+		for _, suffix := range termSuffixes(term) {
+			if i, err := tx.Bucket(suffixes).CreateBucketIfNotExists([]byte(suffix)); err == nil {
+				if w, _ := strconv.Atoi(string(i.Get(id))); w < weight {
+					i.Put(id, []byte(strconv.Itoa(weight)))
+				}
+			}
+		}
+	}
+}
+
+// termSuffixes returns proper suffixes of term, which start at character boundaries
+func termSuffixes(term string) (list []string) {
+	for i := range term {
+		if i != 0 {
+			list = append(list, term[i:])
+		}
+	}
+	return list
+}
+
+// unindexTerm removes record from index bucket entry of term and drops the entry when it becomes empty
+func unindexTerm(b *bolt.Bucket, term, id []byte) {
+	if i := b.Bucket(term); i != nil {
+		i.Delete(id)
+		if k, _ := i.Cursor().First(); k == nil {
+			b.DeleteBucket(term)
+		}
+	}
+}
+
+// unindexRecord removes all search index entries of record
+func unindexRecord(tx *bolt.Tx, id []byte) {
+	b := tx.Bucket(bucket).Bucket(id)
+	if b == nil || b.Bucket([]byte("terms")) == nil {
+		return
+	}
+	var list [][]byte
+	b.Bucket([]byte("terms")).ForEach(func(k, v []byte) error {
+		list = append(list, append([]byte(nil), k...))
+		return nil
+	})
+	for _, term := range list {
+		unindexTerm(tx.Bucket(index), term, id)
+		for _, suffix := range termSuffixes(string(term)) {
+			unindexTerm(tx.Bucket(suffixes), []byte(suffix), id)
+		}
+	}
+	b.DeleteBucket([]byte("terms"))
+}
+
+// migrateIndex builds search index of existing records
+func migrateIndex(tx *bolt.Tx) {
+	var list [][]byte
+	tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+		if v == nil {
+			list = append(list, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, id := range list {
+		indexRecord(tx, id)
+	}
+}
+
+// Search returns IDs of records which contain all words of query, either whole or as part of indexed term,
+// the same way as former search by file name did. Whole terms weigh more than prefixes and prefixes weigh more
+// than other parts of terms. Results are ordered by relevance, then newer records first.
+// Empty query returns all records.
+func Search(query string) (list []string) {
+	words := splitWords(query)
+	scores := make(map[string]int)
+	dates := make(map[string]time.Time)
+	db.View(func(tx *bolt.Tx) error {
+		if len(words) == 0 {
+			tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+				if v == nil {
+					scores[string(k)] = 0
+				}
+				return nil
+			})
+		}
+		for i, word := range words {
+			found := make(map[string]int)
+			c := tx.Bucket(index).Cursor()
+			for k, v := c.Seek([]byte(word)); k != nil && bytes.HasPrefix(k, []byte(word)); k, v = c.Next() {
+				if v != nil {
+					continue
+				}
+				bonus := 2
+				if string(k) == word {
+					bonus = 3
+				}
+				tx.Bucket(index).Bucket(k).ForEach(func(id, weight []byte) error {
+					w, _ := strconv.Atoi(string(weight))
+					found[string(id)] += w * bonus
+					return nil
+				})
+			}
+			// Word may be found in several suffixes of the same term, so only the best one counts
+			inner := make(map[string]int)
+			c = tx.Bucket(suffixes).Cursor()
+			for k, v := c.Seek([]byte(word)); k != nil && bytes.HasPrefix(k, []byte(word)); k, v = c.Next() {
+				if v != nil {
+					continue
+				}
+				tx.Bucket(suffixes).Bucket(k).ForEach(func(id, weight []byte) error {
+					if w, _ := strconv.Atoi(string(weight)); w > inner[string(id)] {
+						inner[string(id)] = w
+					}
+					return nil
+				})
+			}
+			for id, w := range inner {
+				found[id] += w
+			}
+			for id, score := range found {
+				if i == 0 {
+					scores[id] = score
+				} else if _, ok := scores[id]; ok {
+					scores[id] += score
+				}
+			}
+			for id := range scores {
+				if _, ok := found[id]; !ok {
+					delete(scores, id)
+				}
+			}
+		}
+		for id := range scores {
+			if b := tx.Bucket(bucket).Bucket([]byte(id)); b != nil {
+				date := new(time.Time)
+				date.UnmarshalText(b.Get([]byte("date")))
+				dates[id] = *date
+			}
+			list = append(list, id)
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool {
+		if scores[list[i]] != scores[list[j]] {
+			return scores[list[i]] > scores[list[j]]
+		}
+		return dates[list[i]].After(dates[list[j]])
+	})
+	return list
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	Write("searcher", "search-1", "foobar-subutai-template_1.0_amd64.tar.gz", map[string]string{"type": "template"})
+	Write("searcher", "search-2", "bar-subutai-template_1.0_amd64.tar.gz", map[string]string{"type": "template"})
+	Write("searcher", "search-3", "libbarista_2.1_all.deb", map[string]string{"type": "apt"})
+	defer func() {
+		for _, id := range []string{"search-1", "search-2", "search-3"} {
+			Delete("searcher", "", id)
+		}
+	}()
+
+	cases := []struct {
+		query string
+		list  []string
+	}{
+		{"bar", []string{"search-1", "search-2", "search-3"}},
+		{"oba", []string{"search-1"}},
+		{"FOOBAR", []string{"search-1"}},
+		{"bar-subutai", []string{"search-1", "search-2"}},
+		{"arista deb", []string{"search-3"}},
+		{"bar zzz", nil},
+	}
+	for _, c := range cases {
+		var list []string
+		for _, id := range Search(c.query) {
+			if id == "search-1" || id == "search-2" || id == "search-3" {
+				list = append(list, id)
+			}
+		}
+		sort.Strings(list)
+		if !reflect.DeepEqual(list, c.list) {
+			t.Errorf("Search(%q) returned %v, expected %v", c.query, list, c.list)
+		}
+	}
+	if list := Search("bar"); len(list) == 0 || list[0] != "search-2" {
+		t.Errorf("Whole term is not ranked first: %v", list)
+	}
+
+	Delete("searcher", "", "search-3")
+	for _, query := range []string{"libbarista", "arista"} {
+		for _, id := range Search(query) {
+			if id == "search-3" {
+				t.Errorf("Search(%q) returned deleted record", query)
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Organizations are kept in Users bucket like users, so they own files, have storage quota and can be shared with.
+// Bucket of organization is marked with "org" key and has "members" bucket with roles of its members:
+// "owner" manages members, "maintainer" publishes and removes artifacts of organization, and every member
+// has access to artifacts shared with organization. Organizations of user are also kept in "orgs" bucket
+// of the user, so access checks do not scan all organizations.
+
+// OrgRoles lists roles of organization members
+var OrgRoles = []string{"owner", "maintainer", "member"}
+
+// CreateOrg creates organization with user as its owner. It returns false if the name is already taken.
+func CreateOrg(name, owner string) (created bool) {
+	name = strings.ToLower(name)
+	db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(users).Bucket([]byte(name)) != nil {
+			return nil
+		}
+		b, err := tx.Bucket(users).CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		b.Put([]byte("org"), []byte("true"))
+		setMember(tx, name, owner, "owner")
+		created = true
+		return nil
+	})
+	return created
+}
+
+// DeleteOrg removes organization which does not own any files
+func DeleteOrg(name string) (deleted bool) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := orgBucket(tx, name); b != nil {
+			if f := b.Bucket([]byte("files")); f != nil {
+				if k, _ := f.Cursor().First(); k != nil {
+					return nil
+				}
+			}
+			if m := b.Bucket([]byte("members")); m != nil {
+				m.ForEach(func(k, v []byte) error {
+					if o := userBucket(tx, string(k), "orgs"); o != nil {
+						o.Delete([]byte(strings.ToLower(name)))
+					}
+					return nil
+				})
+			}
+			deleted = tx.Bucket(users).DeleteBucket([]byte(strings.ToLower(name))) == nil
+		}
+		return nil
+	})
+	return deleted
+}
+
+// IsOrg checks if name belongs to organization
+func IsOrg(name string) (org bool) {
+	db.View(func(tx *bolt.Tx) error {
+		org = orgBucket(tx, name) != nil
+		return nil
+	})
+	return org
+}
+
+// OrgMembers returns members of organization with their roles
+func OrgMembers(name string) map[string]string {
+	list := make(map[string]string)
+	db.View(func(tx *bolt.Tx) error {
+		if b := orgBucket(tx, name); b != nil && b.Bucket([]byte("members")) != nil {
+			b.Bucket([]byte("members")).ForEach(func(k, v []byte) error {
+				list[string(k)] = string(v)
+				return nil
+			})
+		}
+		return nil
+	})
+	return list
+}
+
+// OrgRole returns role of user in organization, or empty string if user is not a member
+func OrgRole(name, user string) string {
+	return OrgMembers(name)[strings.ToLower(user)]
+}
+
+// OrgMaintainer checks if user may publish and remove artifacts of organization
+func OrgMaintainer(name, user string) bool {
+	role := OrgRole(name, user)
+	return role == "owner" || role == "maintainer"
+}
+
+// SetOrgMember adds user to organization or changes role of member
+func SetOrgMember(name, user, role string) {
+	db.Update(func(tx *bolt.Tx) error {
+		if orgBucket(tx, name) != nil {
+			setMember(tx, name, user, role)
+		}
+		return nil
+	})
+}
+
+// RemoveOrgMember removes user from organization
+func RemoveOrgMember(name, user string) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := orgBucket(tx, name); b != nil && b.Bucket([]byte("members")) != nil {
+			b.Bucket([]byte("members")).Delete([]byte(strings.ToLower(user)))
+		}
+		if o := userBucket(tx, user, "orgs"); o != nil {
+			o.Delete([]byte(strings.ToLower(name)))
+		}
+		return nil
+	})
+}
+
+// UserOrgs returns organizations which user is member of, with user's roles
+func UserOrgs(user string) map[string]string {
+	list := make(map[string]string)
+	db.View(func(tx *bolt.Tx) error {
+		for _, org := range userOrgs(tx, user) {
+			list[org] = string(orgBucket(tx, org).Bucket([]byte("members")).Get([]byte(strings.ToLower(user))))
+		}
+		return nil
+	})
+	return list
+}
+
+// ActingOwner returns name on behalf of which user manages artifact in repo: user itself if user owns it,
+// or organization owning the artifact if user is its owner or maintainer. Empty string means user can not manage artifact.
+func ActingOwner(user, repo, id string) string {
+	if len(user) == 0 {
+		return ""
+	}
+	if CheckRepo(user, repo, id) != 0 {
+		return user
+	}
+	for org, role := range UserOrgs(user) {
+		if (role == "owner" || role == "maintainer") && CheckRepo(org, repo, id) != 0 {
+			return org
+		}
+	}
+	return ""
+}
+
+// Transfer moves artifact in repo from one owner to another, e.g. uploads of leaving member to organization.
+// Shares of artifact are kept, storage quota is charged to the new owner if it allows. Signature of previous
+// owner is not moved, as it does not belong to the new owner.
+func Transfer(id, repo, from, to string) error {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket).Bucket([]byte(id))
+		if b == nil || from == to {
+			return fmt.Errorf("Artifact %s not found", id)
+		}
+		sha256 := append([]byte(nil), recordSum(tx, []byte(id))...)
+		if s := tx.Bucket(blobs).Bucket(sha256); s != nil {
+			size, _ := strconv.Atoi(string(s.Get([]byte("size"))))
+			if left := quotaLeft(tx, to); left != -1 && size >= left {
+				return fmt.Errorf("Storage quota of %s exceeded", to)
+			}
+		}
+		if t := b.Bucket([]byte("type")); t != nil {
+			r := t.Bucket([]byte(repo))
+			if r == nil || r.Get([]byte(from)) == nil {
+				return fmt.Errorf("Artifact %s of %s not found in %s repo", id, from, repo)
+			}
+			r.Delete([]byte(from))
+			r.Put([]byte(to), []byte("w"))
+		} else if o := b.Bucket([]byte("owner")); o == nil || o.Get([]byte(from)) == nil || string(b.Get([]byte("type"))) != repo {
+			return fmt.Errorf("Artifact %s of %s not found in %s repo", id, from, repo)
+		}
+		if o := b.Bucket([]byte("owner")); o != nil && o.Get([]byte(from)) != nil {
+			o.Delete([]byte(from))
+			o.Put([]byte(to), []byte("w"))
+		}
+
+		if s := b.Bucket([]byte("scope")); s != nil && s.Bucket([]byte(from)) != nil {
+			var list [][]byte
+			s.Bucket([]byte(from)).ForEach(func(k, v []byte) error {
+				if string(k) == from {
+					k = []byte(to)
+				}
+				list = append(list, append([]byte(nil), k...))
+				return nil
+			})
+			s.DeleteBucket([]byte(from))
+			if n, err := s.CreateBucketIfNotExists([]byte(to)); err == nil {
+				for _, k := range list {
+					n.Put(k, []byte("w"))
+				}
+			}
+		}
+
+		var name []byte
+		if f := userBucket(tx, from, "files"); f != nil {
+			name = append([]byte(nil), f.Get([]byte(id))...)
+			f.Delete([]byte(id))
+		}
+		if u, err := tx.Bucket(users).CreateBucketIfNotExists([]byte(to)); err == nil {
+			if f, err := u.CreateBucketIfNotExists([]byte("files")); err == nil {
+				if len(name) == 0 {
+					name = b.Get([]byte("name"))
+				}
+				f.Put([]byte(id), name)
+			}
+		}
+
+		// Reference of the new owner is added first, so blob is not dropped while it has no references
+		if tx.Bucket(blobs).Bucket(sha256) != nil {
+			attach(tx, sha256, recordKey(tx, []byte(id)), id, to, 0, true)
+			detach(tx, sha256, id, from)
+		}
+		indexRecord(tx, []byte(id))
+		return nil
+	})
+}
+
+func orgBucket(tx *bolt.Tx, name string) *bolt.Bucket {
+	if b := tx.Bucket(users).Bucket([]byte(strings.ToLower(name))); b != nil && b.Get([]byte("org")) != nil {
+		return b
+	}
+	return nil
+}
+
+// setMember stores role of user both in organization and in the user's list of organizations
+func setMember(tx *bolt.Tx, org, user, role string) {
+	org, user = strings.ToLower(org), strings.ToLower(user)
+	if m, err := orgBucket(tx, org).CreateBucketIfNotExists([]byte("members")); err == nil {
+		m.Put([]byte(user), []byte(role))
+	}
+	if u, err := tx.Bucket(users).CreateBucketIfNotExists([]byte(user)); err == nil {
+		if o, err := u.CreateBucketIfNotExists([]byte("orgs")); err == nil {
+			o.Put([]byte(org), []byte(role))
+		}
+	}
+}
+
+// userBucket returns nested bucket of user, or nil if it does not exist
+func userBucket(tx *bolt.Tx, user, name string) *bolt.Bucket {
+	if b := tx.Bucket(users).Bucket([]byte(strings.ToLower(user))); b != nil {
+		return b.Bucket([]byte(name))
+	}
+	return nil
+}
+
+// userOrgs returns organizations which user is member of
+func userOrgs(tx *bolt.Tx, user string) (list []string) {
+	if o := userBucket(tx, user, "orgs"); o != nil {
+		o.ForEach(func(k, v []byte) error {
+			if orgBucket(tx, string(k)) != nil {
+				list = append(list, string(k))
+			}
+			return nil
+		})
+	}
+	return list
+}
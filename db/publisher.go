@@ -0,0 +1,60 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+)
+
+// Publishers bucket keeps users whose signed artifacts are treated as verified,
+// with date of addition and admin who added the publisher.
+
+// Publishers returns list of verified publishers
+func Publishers() (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(publishers).ForEach(func(k, v []byte) error {
+			list = append(list, string(k))
+			return nil
+		})
+	})
+	return list
+}
+
+// Publisher checks if user is verified publisher
+func Publisher(name string) (verified bool) {
+	db.View(func(tx *bolt.Tx) error {
+		verified = tx.Bucket(publishers).Bucket([]byte(strings.ToLower(name))) != nil
+		return nil
+	})
+	return verified
+}
+
+// AddPublisher adds user to verified publishers
+func AddPublisher(name, by string) {
+	log.Check(log.WarnLevel, "Adding publisher "+name, db.Update(func(tx *bolt.Tx) error {
+		return addPublisher(tx, name, by)
+	}))
+}
+
+// RemovePublisher removes user from verified publishers
+func RemovePublisher(name string) {
+	db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(publishers).Bucket([]byte(strings.ToLower(name))) != nil {
+			return tx.Bucket(publishers).DeleteBucket([]byte(strings.ToLower(name)))
+		}
+		return nil
+	})
+}
+
+func addPublisher(tx *bolt.Tx, name, by string) error {
+	b, err := tx.Bucket(publishers).CreateBucketIfNotExists([]byte(strings.ToLower(name)))
+	if err != nil {
+		return err
+	}
+	now, _ := time.Now().MarshalText()
+	b.Put([]byte("date"), now)
+	b.Put([]byte("by"), []byte(by))
+	return nil
+}
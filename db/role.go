@@ -0,0 +1,112 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Roles bucket keeps roles assigned to users: Roles/<user>/<role> holds date of assignment.
+// Every role grants set of permissions, which are checked by handlers before serving requests.
+
+// RolePermissions lists permissions granted by roles
+var RolePermissions = map[string][]string{
+	"admin":         {"read", "upload", "delete", "share", "quota", "admin"},
+	"publisher":     {"upload", "delete", "share"},
+	"reader":        {"read"},
+	"quota-manager": {"quota"},
+}
+
+// defaultRoles are assigned to newly registered users
+var defaultRoles = []string{"publisher", "reader"}
+
+// UserRoles returns roles assigned to user
+func UserRoles(name string) (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(roles).Bucket([]byte(strings.ToLower(name))); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				list = append(list, string(k))
+				return nil
+			})
+		}
+		return nil
+	})
+	return list
+}
+
+// RoleUsers returns users who have role assigned
+func RoleUsers(role string) (list []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(roles).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(roles).Bucket(k); b != nil && b.Get([]byte(role)) != nil {
+				list = append(list, string(k))
+			}
+			return nil
+		})
+	})
+	return list
+}
+
+// Allowed checks if any role of user grants permission
+func Allowed(name, permission string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, role := range UserRoles(name) {
+		for _, p := range RolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GrantRole assigns role to user
+func GrantRole(name, role string) {
+	db.Update(func(tx *bolt.Tx) error {
+		return grantRole(tx, name, role)
+	})
+}
+
+// RevokeRole removes role from user
+func RevokeRole(name, role string) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(roles).Bucket([]byte(strings.ToLower(name))); b != nil {
+			return b.Delete([]byte(role))
+		}
+		return nil
+	})
+}
+
+func grantRole(tx *bolt.Tx, name, role string) error {
+	b, err := tx.Bucket(roles).CreateBucketIfNotExists([]byte(strings.ToLower(name)))
+	if err != nil {
+		return err
+	}
+	now, _ := time.Now().MarshalText()
+	return b.Put([]byte(role), now)
+}
+
+// migrateRoles assigns roles equivalent to previous hard-coded rules: Hub and subutai accounts are administrators
+// and quota managers, other known users may publish and read artifacts
+func migrateRoles(tx *bolt.Tx) {
+	var list []string
+	tx.Bucket(users).ForEach(func(k, v []byte) error {
+		if v == nil {
+			list = append(list, string(k))
+		}
+		return nil
+	})
+	for _, name := range list {
+		for _, role := range defaultRoles {
+			grantRole(tx, name, role)
+		}
+	}
+	for _, name := range []string{"hub", "subutai"} {
+		for _, role := range []string{"admin", "quota-manager"} {
+			grantRole(tx, name, role)
+		}
+	}
+}
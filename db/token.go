@@ -0,0 +1,207 @@
+package db
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/gorjun/config"
+)
+
+// Tokens bucket keeps API tokens by their sha256 hashes. Every token has owner name, creation and expiration
+// dates, allowed scopes and optional repo restriction. Tokens issued before scopes were introduced
+// allow everything and expire after configured lifetime since creation.
+
+// Scopes lists operations which token may be allowed to perform
+var Scopes = []string{"read", "upload", "delete", "share", "admin"}
+
+// DefaultScopes are given to token when no scope is requested, "admin" scope must be requested explicitly
+var DefaultScopes = []string{"read", "upload", "delete", "share"}
+
+// SaveToken saves hash of user's token with allowed scopes and repo restriction, empty repo means any repo
+func SaveToken(name, token string, scope []string, repo string, ttl time.Duration) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b, _ := tx.Bucket(tokens).CreateBucketIfNotExists([]byte(token)); b != nil {
+			now := time.Now()
+			date, _ := now.MarshalText()
+			expires, _ := now.Add(ttl).MarshalText()
+			b.Put([]byte("name"), []byte(name))
+			b.Put([]byte("date"), date)
+			b.Put([]byte("expires"), expires)
+			b.Put([]byte("scope"), []byte(strings.Join(scope, ",")))
+			b.Put([]byte("repo"), []byte(repo))
+		}
+		return nil
+	})
+}
+
+// CheckToken returns name of user who owns valid token
+func CheckToken(token string) (name string) {
+	return CheckTokenScope(token, "", "")
+}
+
+// CheckTokenScope returns name of user who owns valid token if the token allows operation of scope in repo.
+// Empty scope or repo is not checked.
+func CheckTokenScope(token, scope, repo string) (name string) {
+	token = fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(tokens).Bucket([]byte(token)); b != nil {
+			if tokenExpired(b, time.Now()) {
+				return nil
+			}
+			if len(scope) != 0 && b.Get([]byte("scope")) != nil && !in(scope, strings.Split(string(b.Get([]byte("scope"))), ",")) {
+				return nil
+			}
+			if r := string(b.Get([]byte("repo"))); len(repo) != 0 && len(r) != 0 && r != repo {
+				return nil
+			}
+			if value := b.Get([]byte("name")); value != nil {
+				name = string(value)
+			}
+		}
+		return nil
+	})
+	return name
+}
+
+// TokenRepo returns repo which valid token is restricted to, empty string means any repo
+func TokenRepo(token string) (repo string) {
+	token = fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(tokens).Bucket([]byte(token)); b != nil && !tokenExpired(b, time.Now()) {
+			repo = string(b.Get([]byte("repo")))
+		}
+		return nil
+	})
+	return repo
+}
+
+// tokenExpired checks if token is expired at specified time
+func tokenExpired(b *bolt.Bucket, now time.Time) bool {
+	expires := new(time.Time)
+	if expires.UnmarshalText(b.Get([]byte("expires"))) != nil {
+		date := new(time.Time)
+		date.UnmarshalText(b.Get([]byte("date")))
+		*expires = date.Add(config.TokenTTL())
+	}
+	return expires.Before(now)
+}
+
+// Tokens returns valid tokens of user with their properties. Tokens are identified by their hashes.
+func Tokens(name string) (list []map[string]string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokens).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(tokens).Bucket(k); b != nil && string(b.Get([]byte("name"))) == name && !tokenExpired(b, time.Now()) {
+				scope := strings.Join(Scopes, ",")
+				if b.Get([]byte("scope")) != nil {
+					scope = string(b.Get([]byte("scope")))
+				}
+				list = append(list, map[string]string{
+					"id":      string(k),
+					"name":    name,
+					"scope":   scope,
+					"repo":    string(b.Get([]byte("repo"))),
+					"date":    string(b.Get([]byte("date"))),
+					"expires": string(b.Get([]byte("expires"))),
+				})
+			}
+			return nil
+		})
+	})
+	return list
+}
+
+// RevokeToken removes token by its ID. If name is not empty, token is removed only if it belongs to that user.
+func RevokeToken(id, name string) (revoked bool) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(tokens).Bucket([]byte(id)); b != nil && (len(name) == 0 || string(b.Get([]byte("name"))) == name) {
+			revoked = tx.Bucket(tokens).DeleteBucket([]byte(id)) == nil
+		}
+		return nil
+	})
+	return revoked
+}
+
+// SaveAuthID saves authentication challenge issued to user
+func SaveAuthID(name, token string) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b, _ := tx.Bucket(authID).CreateBucketIfNotExists([]byte(token)); b != nil {
+			now, _ := time.Now().MarshalText()
+			b.Put([]byte("name"), []byte(name))
+			b.Put([]byte("date"), now)
+		}
+		return nil
+	})
+}
+
+// CheckAuthID checks if authentication challenge was issued to user and is not expired.
+// Challenge can be used only once.
+func CheckAuthID(name, token string) (valid bool) {
+	db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(authID).Bucket([]byte(token)); b != nil && len(token) != 0 && string(b.Get([]byte("name"))) == name {
+			date := new(time.Time)
+			date.UnmarshalText(b.Get([]byte("date")))
+			valid = date.Add(config.ChallengeTTL()).After(time.Now())
+			return tx.Bucket(authID).DeleteBucket([]byte(token))
+		}
+		return nil
+	})
+	return valid
+}
+
+// ExpireTokens removes expired tokens and authentication challenges. It returns number of removed records.
+func ExpireTokens() (removed int) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		var expired [][]byte
+		tx.Bucket(tokens).ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(tokens).Bucket(k); b == nil || tokenExpired(b, now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if tx.Bucket(tokens).Bucket(k) != nil {
+				tx.Bucket(tokens).DeleteBucket(k)
+			} else {
+				tx.Bucket(tokens).Delete(k)
+			}
+		}
+		removed = len(expired)
+
+		// Challenges saved without date by older versions are removed as well
+		expired = expired[:0]
+		tx.Bucket(authID).ForEach(func(k, v []byte) error {
+			date := new(time.Time)
+			if b := tx.Bucket(authID).Bucket(k); b == nil || date.UnmarshalText(b.Get([]byte("date"))) != nil ||
+				date.Add(config.ChallengeTTL()).Before(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if tx.Bucket(authID).Bucket(k) != nil {
+				tx.Bucket(authID).DeleteBucket(k)
+			} else {
+				tx.Bucket(authID).Delete(k)
+			}
+		}
+		removed += len(expired)
+		return nil
+	})
+	log.Check(log.WarnLevel, "Removing expired tokens", err)
+	return removed
+}
+
+func in(str string, list []string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -3,11 +3,9 @@ package download
 import (
 	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +13,8 @@ import (
 	"github.com/subutai-io/agent/log"
 	"github.com/subutai-io/gorjun/config"
 	"github.com/subutai-io/gorjun/db"
+	"github.com/subutai-io/gorjun/pgp"
+	"github.com/subutai-io/gorjun/storage"
 )
 
 // ListItem describes Gorjun entity. It can be APT package, Subutai template or Raw file.
@@ -34,6 +34,8 @@ type ListItem struct {
 	Signature    map[string]string `json:"signature,omitempty"`
 	Description  string            `json:"description,omitempty"`
 	Architecture string            `json:"architecture,omitempty"`
+
+	repo string
 }
 
 type hashsums struct {
@@ -45,57 +47,46 @@ type hashsums struct {
 func Handler(repo string, w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	name := r.URL.Query().Get("name")
-	if len(id) == 0 && len(name) == 0 {
-		io.WriteString(w, "Please specify id or name")
+	alias := r.URL.Query().Get("alias")
+	if len(id) == 0 && len(name) == 0 && len(alias) == 0 {
+		io.WriteString(w, "Please specify id, name or alias")
 		return
 	} else if len(name) != 0 {
-		id = db.LastHash(name, repo)
+		// Without version the highest one is downloaded, the same as Info shows as the latest
+		version := r.URL.Query().Get("version")
+		if id = resolve(repo, name, version, r.URL.Query().Get("token")); len(id) == 0 && len(version) == 0 {
+			// Names were matched case-insensitively by search index of file names
+			id = db.LastHash(name, repo)
+		}
+	} else if len(alias) != 0 {
+		id = db.Alias(r.URL.Query().Get("owner"), repo, alias)
 	}
 
-	if len(db.Read(id)) > 0 && !db.Public(id) && !db.CheckShare(id, db.CheckToken(r.URL.Query().Get("token"))) {
+	if len(db.Read(id)) > 0 && !db.Public(id) && !db.CheckShare(id, db.CheckTokenScope(r.URL.Query().Get("token"), "read", repo)) {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Not found"))
 		return
 	}
 
-	path := config.Storage.Path + id
+	key := id
 	if md5, _ := db.Hash(id); len(md5) != 0 {
-		path = config.Storage.Path + md5
+		key = md5
 	}
 
-	f, err := os.Open(path)
-	defer f.Close()
-
-	if log.Check(log.WarnLevel, "Opening file "+config.Storage.Path+id, err) || len(id) == 0 {
-		if len(config.CDN.Node) > 0 {
-			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
-			resp, err := client.Get(config.CDN.Node + r.URL.RequestURI())
-			if !log.Check(log.WarnLevel, "Getting file from CDN", err) {
-				w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
-				w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-				w.Header().Set("Last-Modified", resp.Header.Get("Last-Modified"))
-				w.Header().Set("Content-Disposition", resp.Header.Get("Content-Disposition"))
-
-				io.Copy(w, resp.Body)
-				resp.Body.Close()
-				return
-			}
+	f, fi, err := storage.Open(key)
+	if log.Check(log.WarnLevel, "Opening file "+key, err) || len(id) == 0 {
+		if len(config.CDN.Node) > 0 && proxy(w, r) {
+			return
 		}
 
 		w.WriteHeader(http.StatusNotFound)
 		io.WriteString(w, "File not found")
 		return
 	}
-	fi, _ := f.Stat()
-
-	if t, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil && fi.ModTime().Unix() <= t.Unix() {
-		w.WriteHeader(http.StatusNotModified)
-		return
-	}
+	defer f.Close()
 
-	w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
 	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
-	w.Header().Set("Last-Modified", fi.ModTime().Format(http.TimeFormat))
+	w.Header().Set("ETag", "\""+key+"\"")
 
 	if name = db.Read(id); len(name) == 0 && len(config.CDN.Node) > 0 {
 		httpclient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
@@ -117,11 +108,50 @@ func Handler(repo string, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Disposition", "attachment; filename=\""+db.Read(id)+"\"")
 	}
 
-	io.Copy(w, f)
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since headers
+	http.ServeContent(w, r, "", fi.ModTime, f)
+}
+
+// proxy relays download request to CDN node, passing range and conditional headers in both directions
+func proxy(w http.ResponseWriter, r *http.Request) bool {
+	req, err := http.NewRequest("GET", config.CDN.Node+r.URL.RequestURI(), nil)
+	if log.Check(log.WarnLevel, "Preparing CDN request", err) {
+		return false
+	}
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if v := r.Header.Get(h); len(v) != 0 {
+			req.Header.Set(h, v)
+		}
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Do(req)
+	if log.Check(log.WarnLevel, "Getting file from CDN", err) {
+		return false
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Length", "Content-Type", "Content-Range", "Last-Modified", "Content-Disposition", "ETag", "Accept-Ranges"} {
+		if v := resp.Header.Get(h); len(v) != 0 {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
 }
 
 // Info returns JSON formatted list of elements. It allows to apply some filters to Search.
 func Info(repo string, r *http.Request) []byte {
+	output, err := json.Marshal(List(repo, r))
+	if err != nil || string(output) == "null" {
+		return nil
+	}
+	return output
+}
+
+// List returns list of elements found in repo according to request filters.
+func List(repo string, r *http.Request) []ListItem {
 	var items []ListItem
 	var fullname bool
 	p := []int{0, 1000}
@@ -139,6 +169,29 @@ func Info(repo string, r *http.Request) []byte {
 		name = subname
 	}
 
+	pstr := strings.Split(page, ",")
+	p[0], _ = strconv.Atoi(pstr[0])
+	if len(pstr) == 2 {
+		p[1], _ = strconv.Atoi(pstr[1])
+	}
+
+	// Filter expression replaces other filters
+	if len(r.URL.Query().Get("q")) != 0 {
+		items = filter(repo, r)
+		if p[0] > len(items) {
+			items = nil
+		} else if p[0] > 1 {
+			items = items[p[0]-1:]
+		}
+		if len(items) > p[1] {
+			items = items[:p[1]]
+		}
+		if len(items) == 1 {
+			items[0].Signature = db.FileSignatures(items[0].ID)
+		}
+		return items
+	}
+
 	list := db.Search(name)
 	if len(tag) > 0 {
 		listByTag, err := db.Tag(tag)
@@ -149,22 +202,14 @@ func Info(repo string, r *http.Request) []byte {
 	if len(id) > 0 {
 		list = append(list[:0], id)
 	} else if verified == "true" {
-		items = append(items, getVerified(list, name, repo))
-		output, err := json.Marshal(items)
-		if err == nil && len(items) > 0 && items[0].ID != "" {
-			return output
+		if item := getVerified(list, name, repo, token); item.ID != "" {
+			return []ListItem{item}
 		}
 		return nil
 	}
 
-	pstr := strings.Split(page, ",")
-	p[0], _ = strconv.Atoi(pstr[0])
-	if len(pstr) == 2 {
-		p[1], _ = strconv.Atoi(pstr[1])
-	}
-
 	for _, k := range list {
-		if (!db.Public(k) && !db.CheckShare(k, db.CheckToken(token))) ||
+		if (!db.Public(k) && !db.CheckShare(k, db.CheckTokenScope(token, "read", repo))) ||
 			(len(owner) > 0 && db.CheckRepo(owner, repo, k) == 0) ||
 			db.CheckRepo("", repo, k) == 0 {
 			continue
@@ -176,12 +221,15 @@ func Info(repo string, r *http.Request) []byte {
 
 		item := formatItem(db.Info(k), repo, name)
 
-		if len(subname) == 0 && name == item.Name {
-			if strings.HasSuffix(item.Version, version) || len(version) == 0 {
+		// Versions of apt packages are listed separately, while other artifacts are collapsed to the newest item,
+		// or to the highest version if version is requested
+		if len(subname) == 0 && name == item.Name && repo != "apt" {
+			if (strings.HasSuffix(item.Version, version) || matchVersion(item.Version, version)) &&
+				(!fullname || newer(item, items[0], len(version) != 0)) {
 				items = []ListItem{item}
 				fullname = true
 			}
-		} else if !fullname && (len(version) == 0 || item.Version == version) {
+		} else if !fullname && matchVersion(item.Version, version) {
 			items = append(items, item)
 		}
 
@@ -192,11 +240,37 @@ func Info(repo string, r *http.Request) []byte {
 	if len(items) == 1 {
 		items[0].Signature = db.FileSignatures(items[0].ID)
 	}
-	output, err := json.Marshal(items)
-	if err != nil || string(output) == "null" {
-		return nil
+	return items
+}
+
+// resolve returns ID of the highest version of artifact with specified name which satisfies requested version
+// and is available for requester
+func resolve(repo, name, version, token string) (id string) {
+	var best ListItem
+	for _, k := range db.Search(name) {
+		if db.CheckRepo("", repo, k) == 0 || !db.Public(k) && !db.CheckShare(k, db.CheckTokenScope(token, "read", repo)) {
+			continue
+		}
+		info := db.Info(k)
+		item := formatItem(info, repo, name)
+		if item.Name != name && info["name"] != name || !matchVersion(item.Version, version) {
+			continue
+		}
+		if len(id) == 0 || newer(item, best, true) {
+			id, best = k, item
+		}
 	}
-	return output
+	return id
+}
+
+// newer checks if item a should be preferred to b: by higher version if byVersion is set, then by upload date
+func newer(a, b ListItem, byVersion bool) bool {
+	if byVersion {
+		if c := compareIn(a.repo, a.Version, b.Version); c != 0 {
+			return c > 0
+		}
+	}
+	return a.Date.After(b.Date)
 }
 
 func in(str string, list []string) bool {
@@ -208,19 +282,29 @@ func in(str string, list []string) bool {
 	return false
 }
 
-func getVerified(list []string, name, repo string) ListItem {
+// getVerified returns the newest artifact with specified name which is signed by verified publisher
+func getVerified(list []string, name, repo, token string) (item ListItem) {
 	for _, k := range list {
-		if info := db.Info(k); db.CheckRepo("", repo, k) > 0 {
-			if info["name"] == name || (strings.HasPrefix(info["name"], name+"-subutai-template") && repo == "template") {
-				for _, owner := range db.FileField(info["id"], "owner") {
-					if in(owner, []string{"subutai", "jenkins", "docker"}) {
-						return formatItem(info, repo, name)
-					}
-				}
-			}
+		if db.CheckRepo("", repo, k) == 0 || !db.Public(k) && !db.CheckShare(k, db.CheckTokenScope(token, "read", repo)) {
+			continue
+		}
+		info := db.Info(k)
+		if v := formatItem(info, repo, name); (v.Name == name || info["name"] == name) && Verified(k) &&
+			(len(item.ID) == 0 || newer(v, item, false)) {
+			item = v
 		}
 	}
-	return ListItem{}
+	return item
+}
+
+// Verified checks if artifact carries valid signature of any verified publisher
+func Verified(id string) bool {
+	for owner, signature := range db.FileSignatures(id) {
+		if db.Publisher(owner) && strings.TrimSpace(pgp.Verify(owner, signature)) == id {
+			return true
+		}
+	}
+	return false
 }
 
 func formatItem(info map[string]string, repo, name string) ListItem {
@@ -244,10 +328,16 @@ func formatItem(info map[string]string, repo, name string) ListItem {
 		Architecture: strings.ToUpper(info["arch"]),
 		Description:  info["Description"],
 		Timestamp:    timestamp,
+		repo:         repo,
 	}
 	item.Size, _ = strconv.Atoi(info["size"])
 
 	if repo == "apt" {
+		for _, field := range []string{"Package", "Source", "name"} {
+			if item.Name = info[field]; len(item.Name) != 0 {
+				break
+			}
+		}
 		item.Version = info["Version"]
 		item.Architecture = info["Architecture"]
 		item.Size, _ = strconv.Atoi(info["Size"])
@@ -0,0 +1,175 @@
+package download
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// Paginated list is requested with "limit" and "cursor" parameters. Response is an envelope with items,
+// total number of matching items and cursor of the next page, which is also sent in Link header.
+// Requests without these parameters get bare array of items as before.
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+type envelope struct {
+	Items []ListItem `json:"items"`
+	Next  string     `json:"next,omitempty"`
+	Total int        `json:"total"`
+}
+
+// cursor points to the last item of previous page by its sort values and ID
+type cursor struct {
+	Values []string `json:"v"`
+	ID     string   `json:"id"`
+}
+
+// Paginated checks if client requested paginated response
+func Paginated(r *http.Request) bool {
+	_, limit := r.URL.Query()["limit"]
+	_, cursor := r.URL.Query()["cursor"]
+	return limit || cursor
+}
+
+// Page writes one page of repo items in envelope. Items are sorted by ORDER BY clause of filter expression,
+// by name and version for apt repo or by upload date otherwise, and by ID at last, so the order is stable.
+func Page(repo string, w http.ResponseWriter, r *http.Request) {
+	if !CheckQuery(w, r) {
+		return
+	}
+	limit := defaultLimit
+	if v := r.URL.Query().Get("limit"); len(v) != 0 {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid limit"))
+			return
+		}
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+	}
+	var after *cursor
+	if v := r.URL.Query().Get("cursor"); len(v) != 0 {
+		after = new(cursor)
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(data, after)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid cursor"))
+			return
+		}
+	}
+
+	order := []orderBy{{field: "uploaded", desc: true}}
+	if repo == "apt" {
+		order = []orderBy{{field: "name"}, {field: "version", desc: true}}
+	}
+	if q, _ := parseQuery(r.URL.Query().Get("q")); len(q.order) != 0 {
+		order = q.order
+	}
+	items := collect(repo, r)
+	sortItems(items, append(order, orderBy{field: "id"}))
+
+	page := envelope{Items: []ListItem{}, Total: len(items)}
+	start := 0
+	if after != nil {
+		for start < len(items) && !after.before(items[start], order) {
+			start++
+		}
+	}
+	for i := start; i < len(items) && len(page.Items) < limit; i++ {
+		page.Items = append(page.Items, items[i])
+	}
+	if n := len(page.Items); n != 0 && start+n < len(items) {
+		last := cursor{ID: page.Items[n-1].ID}
+		for _, o := range order {
+			last.Values = append(last.Values, first(values(page.Items[n-1], o.field)))
+		}
+		data, _ := json.Marshal(last)
+		page.Next = base64.RawURLEncoding.EncodeToString(data)
+
+		next := *r.URL
+		query := next.Query()
+		query.Set("cursor", page.Next)
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+
+	js, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// before checks if cursor position precedes item in specified order
+func (c *cursor) before(item ListItem, order []orderBy) bool {
+	for i, o := range order {
+		var v string
+		if i < len(c.Values) {
+			v = c.Values[i]
+		}
+		if r := compare(item.repo, o.field, first(values(item, o.field)), v); r != 0 {
+			return r > 0 != o.desc
+		}
+	}
+	return compare(item.repo, "id", item.ID, c.ID) > 0
+}
+
+func first(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0]
+}
+
+// collect returns all repo items visible for requester and matching filters of request,
+// either filter expression or id, name, subname, tag, owner, version and verified parameters
+func collect(repo string, r *http.Request) (items []ListItem) {
+	if len(r.URL.Query().Get("q")) != 0 {
+		return filter(repo, r)
+	}
+	id := r.URL.Query().Get("id")
+	name := r.URL.Query().Get("name")
+	subname := r.URL.Query().Get("subname")
+	tag := r.URL.Query().Get("tag")
+	owner := r.URL.Query().Get("owner")
+	version := r.URL.Query().Get("version")
+	token := r.URL.Query().Get("token")
+	verified := r.URL.Query().Get("verified") == "true"
+
+	query := name
+	if len(subname) != 0 {
+		query, name = subname, ""
+	}
+	list := db.Search(query)
+	if len(tag) != 0 {
+		byTag, _ := db.Tag(tag)
+		list = intersect(list, byTag)
+	}
+	if len(id) != 0 {
+		list = append(list[:0], id)
+	}
+	for _, k := range list {
+		if db.CheckRepo("", repo, k) == 0 || len(owner) != 0 && db.CheckRepo(owner, repo, k) == 0 ||
+			!db.Public(k) && !db.CheckShare(k, db.CheckTokenScope(token, "read", repo)) {
+			continue
+		}
+		item := formatItem(db.Info(k), repo, name)
+		if len(name) != 0 && item.Name != name || len(subname) != 0 && !strings.Contains(item.Name, subname) ||
+			!matchVersion(item.Version, version) || verified && !Verified(k) {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,495 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// Filter expressions of q parameter, e.g. `name:nginx* AND arch:amd64 AND uploaded>2026-01-01 ORDER BY version DESC`.
+// Terms are field, operator and value: ":" and "=" match value with "*" wildcards, "!=" negates the match,
+// "<", "<=", ">" and ">=" compare numbers, dates, versions or strings. A word without field matches name.
+// Terms are combined with AND, OR, NOT and parentheses, adjacent terms are joined with AND.
+// Version may also be matched with constraint, e.g. `version:^1.4`.
+
+// fields lists fields available in filter expressions and ORDER BY clause
+var fields = map[string]bool{
+	"id": true, "name": true, "filename": true, "owner": true, "tag": true, "version": true, "arch": true,
+	"description": true, "parent": true, "prefsize": true, "size": true, "uploaded": true, "md5": true, "sha256": true,
+}
+
+type token struct {
+	kind  string // "word", "string", "op", "(", ")", ","
+	value string
+	pos   int
+}
+
+type node interface {
+	match(item ListItem) bool
+}
+
+type andNode struct{ left, right node }
+type orNode struct{ left, right node }
+type notNode struct{ node node }
+
+type term struct {
+	field, op, value string
+}
+
+type orderBy struct {
+	field string
+	desc  bool
+}
+
+type query struct {
+	filter node
+	order  []orderBy
+}
+
+func (n andNode) match(item ListItem) bool { return n.left.match(item) && n.right.match(item) }
+func (n orNode) match(item ListItem) bool  { return n.left.match(item) || n.right.match(item) }
+func (n notNode) match(item ListItem) bool { return !n.node.match(item) }
+
+// lex splits filter expression into tokens
+func lex(input string) (list []token, err error) {
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			list = append(list, token{kind: string(r), value: string(r), pos: i})
+			i++
+		case strings.ContainsRune(":=!<>", r):
+			start := i
+			if i++; i < len(runes) && runes[i] == '=' && r != ':' && r != '=' {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "!" {
+				return nil, fmt.Errorf("Unexpected \"!\" at position %d", start)
+			}
+			list = append(list, token{kind: "op", value: op, pos: start})
+		case r == '"' || r == '\'':
+			start := i
+			var value []rune
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("Unterminated string at position %d", start)
+			}
+			i++
+			list = append(list, token{kind: "string", value: string(value), pos: start})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("():=!<>,\"'", runes[i]) {
+				i++
+			}
+			list = append(list, token{kind: "word", value: string(runes[start:i]), pos: start})
+		}
+	}
+	return list, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{kind: "end", pos: -1}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// keyword checks if next token is specified keyword
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	return t.kind == "word" && strings.EqualFold(t.value, word)
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.kind == "end" {
+		return fmt.Errorf("Unexpected end of query")
+	}
+	return fmt.Errorf("Unexpected %q at position %d", t.value, t.pos)
+}
+
+// parseQuery builds query AST from filter expression
+func parseQuery(input string) (q query, err error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return q, err
+	}
+	p := &parser{tokens: tokens}
+	if !p.keyword("ORDER") && p.peek().kind != "end" {
+		if q.filter, err = p.or(); err != nil {
+			return q, err
+		}
+	}
+	if p.keyword("ORDER") {
+		p.next()
+		if !p.keyword("BY") {
+			return q, p.unexpected(p.peek())
+		}
+		p.next()
+		for {
+			t := p.next()
+			if t.kind != "word" || !fields[strings.ToLower(t.value)] {
+				return q, fmt.Errorf("Unknown sort field %q", t.value)
+			}
+			o := orderBy{field: strings.ToLower(t.value)}
+			if p.keyword("DESC") || p.keyword("ASC") {
+				o.desc = strings.EqualFold(p.next().value, "DESC")
+			}
+			q.order = append(q.order, o)
+			if p.peek().kind != "," {
+				break
+			}
+			p.next()
+		}
+	}
+	if t := p.peek(); t.kind != "end" {
+		return q, p.unexpected(t)
+	}
+	return q, nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("OR") {
+		p.next()
+		var right node
+		if right, err = p.and(); err == nil {
+			left = orNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	for err == nil {
+		if p.keyword("AND") {
+			p.next()
+		} else if t := p.peek(); t.kind == "end" || t.kind == ")" || p.keyword("OR") || p.keyword("ORDER") {
+			break
+		}
+		var right node
+		if right, err = p.unary(); err == nil {
+			left = andNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) unary() (node, error) {
+	if p.keyword("NOT") {
+		p.next()
+		n, err := p.unary()
+		return notNode{n}, err
+	}
+	if p.peek().kind == "(" {
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != ")" {
+			return nil, p.unexpected(t)
+		}
+		return n, nil
+	}
+	return p.term()
+}
+
+func (p *parser) term() (node, error) {
+	t := p.next()
+	if t.kind != "word" && t.kind != "string" {
+		return nil, p.unexpected(t)
+	}
+	if p.peek().kind != "op" {
+		return term{field: "name", op: ":", value: t.value}, nil
+	}
+	field := strings.ToLower(t.value)
+	if t.kind != "word" || !fields[field] {
+		return nil, fmt.Errorf("Unknown field %q at position %d", t.value, t.pos)
+	}
+	op := p.next()
+	v := p.next()
+	if v.kind != "word" && v.kind != "string" {
+		return nil, p.unexpected(v)
+	}
+	return term{field: field, op: op.value, value: v.value}, nil
+}
+
+// values returns values of item field, which term is applied to
+func values(item ListItem, field string) []string {
+	switch field {
+	case "id":
+		return []string{item.ID}
+	case "name":
+		return []string{item.Name}
+	case "filename":
+		return []string{item.Filename}
+	case "owner":
+		return item.Owner
+	case "tag":
+		return item.Tags
+	case "version":
+		return []string{item.Version}
+	case "arch":
+		return []string{item.Architecture}
+	case "description":
+		return []string{item.Description}
+	case "parent":
+		return []string{item.Parent}
+	case "prefsize":
+		return []string{item.Prefsize}
+	case "size":
+		return []string{strconv.Itoa(item.Size)}
+	case "uploaded":
+		return []string{item.Date.Format(time.RFC3339Nano)}
+	case "md5":
+		return []string{item.Hash.Md5}
+	case "sha256":
+		return []string{item.Hash.Sha256}
+	}
+	return nil
+}
+
+func (t term) match(item ListItem) bool {
+	list := values(item, t.field)
+	if t.op == "!=" {
+		return !term{t.field, "=", t.value}.match(item)
+	}
+	for _, v := range list {
+		if t.op == ":" || t.op == "=" {
+			if t.equal(v) {
+				return true
+			}
+			continue
+		}
+		c := compare(item.repo, t.field, v, t.value)
+		switch t.op {
+		case "<":
+			if c < 0 {
+				return true
+			}
+		case "<=":
+			if c <= 0 {
+				return true
+			}
+		case ">":
+			if c > 0 {
+				return true
+			}
+		case ">=":
+			if c >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// equal checks if field value matches term value, which may contain wildcards.
+// Date without time matches the whole day.
+func (t term) equal(v string) bool {
+	if t.field == "uploaded" {
+		if day, err := time.Parse("2006-01-02", t.value); err == nil {
+			date, _ := time.Parse(time.RFC3339Nano, v)
+			return !date.Before(day) && date.Before(day.AddDate(0, 0, 1))
+		}
+		return compare("", t.field, v, t.value) == 0
+	}
+	if t.field == "size" {
+		return compare("", t.field, v, t.value) == 0
+	}
+	if t.field == "version" && isConstraint(t.value) && matchVersion(v, t.value) {
+		return true
+	}
+	pattern := "(?i)^" + strings.Replace(regexp.QuoteMeta(t.value), `\*`, ".*", -1) + "$"
+	matched, _ := regexp.MatchString(pattern, v)
+	return matched
+}
+
+// compare compares field value a with b according to field type, versions are compared by rules of repo
+func compare(repo, field, a, b string) int {
+	switch field {
+	case "size":
+		x, _ := strconv.ParseInt(a, 10, 64)
+		y, _ := strconv.ParseInt(b, 10, 64)
+		return sign(x - y)
+	case "uploaded":
+		x, _ := time.Parse(time.RFC3339Nano, a)
+		y, err := time.Parse(time.RFC3339Nano, b)
+		if err != nil {
+			y, _ = time.Parse("2006-01-02", b)
+		}
+		return sign(x.Sub(y).Nanoseconds())
+	case "version":
+		return compareIn(repo, a, b)
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+func sign(v int64) int {
+	if v < 0 {
+		return -1
+	} else if v > 0 {
+		return 1
+	}
+	return 0
+}
+
+// candidates returns IDs of records which may match filter using search and tag indexes.
+// If filter can not be resolved with indexes, ok is false.
+func candidates(n node) (list []string, ok bool) {
+	switch n := n.(type) {
+	case andNode:
+		l, lok := candidates(n.left)
+		r, rok := candidates(n.right)
+		switch {
+		case lok && rok:
+			return intersect(l, r), true
+		case lok:
+			return l, true
+		case rok:
+			return r, true
+		}
+	case orNode:
+		l, lok := candidates(n.left)
+		r, rok := candidates(n.right)
+		if lok && rok {
+			for _, v := range r {
+				if !in(v, l) {
+					l = append(l, v)
+				}
+			}
+			return l, true
+		}
+	case term:
+		if n.op != ":" && n.op != "=" {
+			return nil, false
+		}
+		exact := !strings.Contains(n.value, "*")
+		// Longest part without wildcards is the most selective word for search index
+		var segment string
+		for _, v := range strings.Split(n.value, "*") {
+			if len(v) > len(segment) {
+				segment = v
+			}
+		}
+		if len(segment) == 0 {
+			return nil, false
+		}
+		switch n.field {
+		case "id":
+			if exact {
+				return []string{n.value}, true
+			}
+		case "tag":
+			if exact {
+				list, _ := db.Tag(n.value)
+				return list, true
+			}
+		case "version":
+			if !isConstraint(n.value) {
+				return db.Search(segment), true
+			}
+		case "name", "owner", "description":
+			return db.Search(segment), true
+		}
+	}
+	return nil, false
+}
+
+// sortItems orders items by fields of ORDER BY clause
+func sortItems(items []ListItem, order []orderBy) {
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, o := range order {
+			a, b := values(items[i], o.field), values(items[j], o.field)
+			var c int
+			switch {
+			case len(a) == 0 || len(b) == 0:
+				c = len(a) - len(b)
+			default:
+				c = compare(items[i].repo, o.field, a[0], b[0])
+			}
+			if c != 0 {
+				return c < 0 != o.desc
+			}
+		}
+		return false
+	})
+}
+
+// CheckQuery validates filter expression and version constraint of request, writing error response if they are invalid
+func CheckQuery(w http.ResponseWriter, r *http.Request) bool {
+	if q := r.URL.Query().Get("q"); len(q) != 0 {
+		if _, err := parseQuery(q); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid query: " + err.Error()))
+			return false
+		}
+	}
+	if v := r.URL.Query().Get("version"); isConstraint(v) {
+		if _, err := parseConstraint(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid version constraint: " + err.Error()))
+			return false
+		}
+	}
+	return true
+}
+
+// Ordered checks if request specifies order of results
+func Ordered(r *http.Request) bool {
+	q, err := parseQuery(r.URL.Query().Get("q"))
+	return err == nil && len(q.order) != 0
+}
+
+// filter returns items of repo matching filter expression of q parameter, visible for requester
+func filter(repo string, r *http.Request) []ListItem {
+	var items []ListItem
+	q, err := parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		return nil
+	}
+	list, ok := candidates(q.filter)
+	if !ok {
+		list = db.Search("")
+	}
+
+	token := r.URL.Query().Get("token")
+	for _, k := range list {
+		if db.CheckRepo("", repo, k) == 0 || !db.Public(k) && !db.CheckShare(k, db.CheckTokenScope(token, "read", repo)) {
+			continue
+		}
+		if item := formatItem(db.Info(k), repo, ""); q.filter == nil || q.filter.match(item) {
+			items = append(items, item)
+		}
+	}
+	sortItems(items, q.order)
+	return items
+}
@@ -0,0 +1,221 @@
+package download
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// format renders query AST in fully parenthesized form
+func format(n node) string {
+	switch n := n.(type) {
+	case andNode:
+		return "(" + format(n.left) + " AND " + format(n.right) + ")"
+	case orNode:
+		return "(" + format(n.left) + " OR " + format(n.right) + ")"
+	case notNode:
+		return "NOT " + format(n.node)
+	case term:
+		return n.field + n.op + n.value
+	}
+	return ""
+}
+
+func TestParseQuery(t *testing.T) {
+	cases := []struct {
+		input  string
+		filter string
+		order  []orderBy
+	}{
+		{"nginx", "name:nginx", nil},
+		{"name:nginx*", "name:nginx*", nil},
+		{"NAME = 'my app'", "name=my app", nil},
+		{`description:"say \"hi\""`, `description:say "hi"`, nil},
+		{"name:a arch:amd64", "(name:a AND arch:amd64)", nil},
+		{"name:a AND arch:amd64 OR tag:x", "((name:a AND arch:amd64) OR tag:x)", nil},
+		{"name:a and (arch:amd64 or arch:all)", "(name:a AND (arch:amd64 OR arch:all))", nil},
+		{"NOT tag:beta size>=1024", "(NOT tag:beta AND size>=1024)", nil},
+		{"not not owner!=jenkins", "NOT NOT owner!=jenkins", nil},
+		{"uploaded>2026-01-01 version<=2.0", "(uploaded>2026-01-01 AND version<=2.0)", nil},
+		{"version:^1.4", "version:^1.4", nil},
+		{"id:abc*", "id:abc*", nil},
+		{"ORDER BY version DESC", "", []orderBy{{"version", true}}},
+		{"name:a order by Size asc, uploaded desc, id", "name:a", []orderBy{{"size", false}, {"uploaded", true}, {"id", false}}},
+	}
+	for _, c := range cases {
+		q, err := parseQuery(c.input)
+		if err != nil {
+			t.Errorf("parseQuery(%q) returned error %v", c.input, err)
+			continue
+		}
+		if f := format(q.filter); f != c.filter {
+			t.Errorf("parseQuery(%q) filter is %s, expected %s", c.input, f, c.filter)
+		}
+		if !reflect.DeepEqual(q.order, c.order) {
+			t.Errorf("parseQuery(%q) order is %v, expected %v", c.input, q.order, c.order)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	cases := []struct {
+		input, err string
+	}{
+		{"name:", "Unexpected end of query"},
+		{"(name:a", "Unexpected end of query"},
+		{"name:a)", `Unexpected ")" at position 6`},
+		{"color:red", `Unknown field "color" at position 0`},
+		{"'name':a", `Unknown field "name" at position 0`},
+		{"name!a", `Unexpected "!" at position 4`},
+		{`name:"abc`, "Unterminated string at position 5"},
+		{"name:a ORDER size", `Unexpected "size" at position 13`},
+		{"ORDER BY color", `Unknown sort field "color"`},
+		{"ORDER BY name DESC name:a", `Unexpected "name" at position 19`},
+		{"name:a OR", "Unexpected end of query"},
+	}
+	for _, c := range cases {
+		if _, err := parseQuery(c.input); err == nil || err.Error() != c.err {
+			t.Errorf("parseQuery(%q) error is %v, expected %q", c.input, err, c.err)
+		}
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	item := ListItem{
+		ID:           "0123abcd",
+		Name:         "nginx",
+		Owner:        []string{"subutai", "jenkins"},
+		Tags:         []string{"web", "stable"},
+		Version:      "1.14.2",
+		Architecture: "amd64",
+		Size:         2048,
+		Date:         time.Date(2026, 3, 15, 10, 30, 0, 0, time.UTC),
+	}
+	cases := []struct {
+		input    string
+		expected bool
+	}{
+		{"nginx", true},
+		{"NGINX", true},
+		{"ngi*", true},
+		{"apache", false},
+		{"owner:jenkins", true},
+		{"owner!=jenkins", false},
+		{"tag:st*", true},
+		{"tag:web AND tag:beta", false},
+		{"tag:web OR tag:beta", true},
+		{"NOT tag:beta", true},
+		{"arch:amd64 (version:^1.14 OR version:^2)", true},
+		{"version:1.14.*", true},
+		{"version>1.9", true},
+		{"version<1.14.10", true},
+		{"size>=2048", true},
+		{"size>2048", false},
+		{"size=2048", true},
+		{"uploaded:2026-03-15", true},
+		{"uploaded:2026-03-16", false},
+		{"uploaded>2026-03-01", true},
+		{`uploaded<"2026-03-15T10:00:00Z"`, false},
+		{`uploaded>"2026-03-15T10:00:00Z"`, true},
+		{"id:0123*", true},
+		{"id:0124*", false},
+	}
+	for _, c := range cases {
+		q, err := parseQuery(c.input)
+		if err != nil {
+			t.Errorf("parseQuery(%q) returned error %v", c.input, err)
+			continue
+		}
+		if r := q.filter.match(item); r != c.expected {
+			t.Errorf("%q matches item: %v, expected %v", c.input, r, c.expected)
+		}
+	}
+}
+
+func TestIDCandidates(t *testing.T) {
+	cases := []struct {
+		input string
+		list  []string
+		ok    bool
+	}{
+		{"id:0123abcd", []string{"0123abcd"}, true},
+		{"id=0123abcd", []string{"0123abcd"}, true},
+		{"id:0123*", nil, false},
+		{"id!=0123abcd", nil, false},
+		{"id:0123abcd OR id:4567", []string{"0123abcd", "4567"}, true},
+		{"id:0123abcd AND size>1", []string{"0123abcd"}, true},
+	}
+	for _, c := range cases {
+		q, err := parseQuery(c.input)
+		if err != nil {
+			t.Errorf("parseQuery(%q) returned error %v", c.input, err)
+			continue
+		}
+		if list, ok := candidates(q.filter); ok != c.ok || !reflect.DeepEqual(list, c.list) {
+			t.Errorf("candidates(%q) = %v, %v, expected %v, %v", c.input, list, ok, c.list, c.ok)
+		}
+	}
+}
+
+func TestSearchCandidates(t *testing.T) {
+	db.Write("searcher", "candidate-1", "candidate-nginx_1.14.2_amd64.deb", map[string]string{"type": "apt"})
+	defer db.Delete("searcher", "", "candidate-1")
+
+	cases := []struct {
+		input string
+		found bool
+		ok    bool
+	}{
+		{"name:candidate-ng*", true, true},
+		{"name:*nginx_1*", true, true},
+		{"name:*-ng*x_*", true, true},
+		{"name:*apache*", false, true},
+		{"name:*", false, false},
+		{"name!=candidate", false, false},
+	}
+	for _, c := range cases {
+		q, err := parseQuery(c.input)
+		if err != nil {
+			t.Errorf("parseQuery(%q) returned error %v", c.input, err)
+			continue
+		}
+		list, ok := candidates(q.filter)
+		if found := in("candidate-1", list); ok != c.ok || found != c.found {
+			t.Errorf("candidates(%q) found record: %v, %v, expected %v, %v", c.input, found, ok, c.found, c.ok)
+		}
+	}
+}
+
+func TestSortItems(t *testing.T) {
+	items := []ListItem{
+		{ID: "a", Name: "b", Version: "1.10.0", Size: 1},
+		{ID: "b", Name: "a", Version: "1.9.0", Size: 3},
+		{ID: "c", Name: "b", Version: "1.2.0", Size: 2},
+	}
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"ORDER BY version", "cba"},
+		{"ORDER BY version DESC", "abc"},
+		{"ORDER BY size DESC", "bca"},
+		{"ORDER BY name, version DESC", "bac"},
+	}
+	for _, c := range cases {
+		q, err := parseQuery(c.input)
+		if err != nil {
+			t.Errorf("parseQuery(%q) returned error %v", c.input, err)
+			continue
+		}
+		sortItems(items, q.order)
+		var ids string
+		for _, v := range items {
+			ids += v.ID
+		}
+		if ids != c.expected {
+			t.Errorf("%q sorted items as %s, expected %s", c.input, ids, c.expected)
+		}
+	}
+}
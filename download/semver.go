@@ -0,0 +1,317 @@
+package download
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version constraints follow common semver notation: "^1.4" allows versions compatible with 1.4.0 (below 2.0.0),
+// "~2.0.3" allows patch updates (below 2.1.0), "1.2.x" or "1.2.*" is any patch of 1.2, comparators ">=1.0 <2.0"
+// are combined with AND, "1.0 - 1.4" is inclusive range and "||" separates alternatives. Pre-release versions
+// satisfy constraint only if it mentions pre-release of the same version. Versions which are not valid
+// semver never satisfy constraints and are ordered below valid ones.
+
+type semver struct {
+	major, minor, patch int64
+	pre                 []string
+}
+
+type comparator struct {
+	op string
+	v  semver
+}
+
+// constraint is a list of alternatives, each of them is a list of comparators which must be satisfied together
+type constraint [][]comparator
+
+var semverRe = regexp.MustCompile(`^[vV]?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// versionParts splits malformed version into numeric and non-numeric parts
+var versionParts = regexp.MustCompile(`\d+|\D+`)
+
+// parseSemver parses version, minor and patch numbers may be omitted
+func parseSemver(s string) (v semver, ok bool) {
+	m := semverRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return v, false
+	}
+	v.major, _ = strconv.ParseInt(m[1], 10, 64)
+	v.minor, _ = strconv.ParseInt(m[2], 10, 64)
+	v.patch, _ = strconv.ParseInt(m[3], 10, 64)
+	if len(m[4]) != 0 {
+		v.pre = strings.Split(m[4], ".")
+	}
+	return v, true
+}
+
+func (v semver) compare(o semver) int {
+	for _, d := range []int64{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if v.pre[i] == o.pre[i] {
+			continue
+		}
+		x, errx := strconv.ParseInt(v.pre[i], 10, 64)
+		y, erry := strconv.ParseInt(o.pre[i], 10, 64)
+		switch {
+		case errx == nil && erry == nil:
+			return sign(x - y)
+		case errx == nil:
+			return -1
+		case erry == nil:
+			return 1
+		}
+		return strings.Compare(v.pre[i], o.pre[i])
+	}
+	return sign(int64(len(v.pre) - len(o.pre)))
+}
+
+// versionOrders keeps version comparisons of repos which do not follow semver, e.g. dpkg rules of apt repo
+var versionOrders = make(map[string]func(a, b string) int)
+
+// VersionOrder sets comparison of artifact versions in repo. It is called on initialization of repo package.
+func VersionOrder(repo string, cmp func(a, b string) int) {
+	versionOrders[repo] = cmp
+}
+
+// compareIn compares versions of artifacts in repo
+func compareIn(repo, a, b string) int {
+	if cmp, ok := versionOrders[repo]; ok {
+		return cmp(a, b)
+	}
+	return compareVersions(a, b)
+}
+
+// compareVersions orders valid semver versions by precedence and puts them above malformed ones,
+// which are compared by their numeric and non-numeric parts
+func compareVersions(a, b string) int {
+	x, okx := parseSemver(a)
+	y, oky := parseSemver(b)
+	switch {
+	case okx && oky:
+		return x.compare(y)
+	case okx:
+		return 1
+	case oky:
+		return -1
+	}
+	p, q := versionParts.FindAllString(a, -1), versionParts.FindAllString(b, -1)
+	for i := 0; i < len(p) && i < len(q); i++ {
+		if p[i] == q[i] {
+			continue
+		}
+		n, errn := strconv.ParseInt(p[i], 10, 64)
+		m, errm := strconv.ParseInt(q[i], 10, 64)
+		if errn == nil && errm == nil {
+			return sign(n - m)
+		}
+		return strings.Compare(p[i], q[i])
+	}
+	return sign(int64(len(p) - len(q)))
+}
+
+// isConstraint checks if version requested by client is a constraint rather than plain version
+func isConstraint(s string) bool {
+	if strings.ContainsAny(s, "^~<>=*|") || strings.Contains(s, " - ") {
+		return true
+	}
+	for _, part := range strings.Split(s, ".") {
+		if part == "x" || part == "X" {
+			return true
+		}
+	}
+	return false
+}
+
+// partial parses version of comparator, which may be incomplete or contain wildcards.
+// It returns the version with missing parts set to zero and number of specified numeric parts.
+func partial(s string) (v semver, n int, err error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "v"), "V")
+	if i := strings.Index(s, "+"); i != -1 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i != -1 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("Invalid version %q", s)
+	}
+	nums := []*int64{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		wildcard := p == "x" || p == "X" || p == "*" || len(p) == 0 && len(parts) == 1
+		switch {
+		case wildcard:
+		case n < i:
+			return v, 0, fmt.Errorf("Invalid version %q", s)
+		default:
+			if *nums[i], err = strconv.ParseInt(p, 10, 64); err != nil || *nums[i] < 0 {
+				return v, 0, fmt.Errorf("Invalid version %q", s)
+			}
+			n++
+		}
+	}
+	if n < 3 {
+		v.pre = nil
+	}
+	return v, n, nil
+}
+
+// bump returns the lowest version above all versions which have the same first n parts
+func bump(v semver, n int) semver {
+	switch n {
+	case 1:
+		return semver{major: v.major + 1}
+	case 2:
+		return semver{major: v.major, minor: v.minor + 1}
+	}
+	return semver{major: v.major, minor: v.minor, patch: v.patch + 1}
+}
+
+// expand converts comparator with operator and possibly incomplete version to plain comparators
+func expand(op, version string) ([]comparator, error) {
+	v, n, err := partial(version)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		if op == "<" || op == ">" {
+			return []comparator{{"<", semver{}}}, nil
+		}
+		return nil, nil
+	}
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", v}, {"<", bump(v, n)}}, nil
+	case "^":
+		switch {
+		case v.major != 0 || n == 1:
+			return []comparator{{">=", v}, {"<", bump(v, 1)}}, nil
+		case v.minor != 0 || n == 2:
+			return []comparator{{">=", v}, {"<", bump(v, 2)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", bump(v, 3)}}, nil
+	case "~":
+		if n == 1 {
+			return []comparator{{">=", v}, {"<", bump(v, 1)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", bump(v, 2)}}, nil
+	case ">":
+		if n == 3 {
+			return []comparator{{">", v}}, nil
+		}
+		return []comparator{{">=", bump(v, n)}}, nil
+	case "<=":
+		if n == 3 {
+			return []comparator{{"<=", v}}, nil
+		}
+		return []comparator{{"<", bump(v, n)}}, nil
+	case ">=", "<":
+		return []comparator{{op, v}}, nil
+	}
+	return nil, fmt.Errorf("Invalid operator %q", op)
+}
+
+// parseConstraint parses version constraint
+func parseConstraint(s string) (c constraint, err error) {
+	for _, alt := range strings.Split(s, "||") {
+		var set []comparator
+		if r := strings.Split(alt, " - "); len(r) == 2 {
+			low, err := expand(">=", r[0])
+			if err != nil {
+				return nil, err
+			}
+			high, err := expand("<=", r[1])
+			if err != nil {
+				return nil, err
+			}
+			set = append(low, high...)
+		} else {
+			fields := strings.FieldsFunc(alt, func(r rune) bool { return r == ' ' || r == ',' })
+			for i := 0; i < len(fields); i++ {
+				f := fields[i]
+				// operator separated from version by space, e.g. ">= 1.0"
+				if strings.Trim(f, "<>=^~") == "" && i+1 < len(fields) {
+					i++
+					f += fields[i]
+				}
+				op := ""
+				for _, o := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+					if strings.HasPrefix(f, o) {
+						op = o
+						break
+					}
+				}
+				list, err := expand(op, strings.TrimPrefix(f, op))
+				if err != nil {
+					return nil, err
+				}
+				set = append(set, list...)
+			}
+		}
+		c = append(c, set)
+	}
+	return c, nil
+}
+
+// match checks if version satisfies constraint
+func (c constraint) match(version string) bool {
+	v, ok := parseSemver(version)
+	if !ok {
+		return false
+	}
+	for _, set := range c {
+		matched, pre := true, len(v.pre) == 0
+		for _, cmp := range set {
+			r := v.compare(cmp.v)
+			switch cmp.op {
+			case "=":
+				matched = matched && r == 0
+			case ">":
+				matched = matched && r > 0
+			case ">=":
+				matched = matched && r >= 0
+			case "<":
+				matched = matched && r < 0
+			case "<=":
+				matched = matched && r <= 0
+			}
+			if len(cmp.v.pre) != 0 && cmp.v.major == v.major && cmp.v.minor == v.minor && cmp.v.patch == v.patch {
+				pre = true
+			}
+		}
+		if matched && pre {
+			return true
+		}
+	}
+	return false
+}
+
+// matchVersion checks if version satisfies requested one, which is either constraint or plain version
+func matchVersion(version, requested string) bool {
+	if len(requested) == 0 || version == requested {
+		return true
+	}
+	if !isConstraint(requested) {
+		return false
+	}
+	c, err := parseConstraint(requested)
+	return err == nil && c.match(version)
+}
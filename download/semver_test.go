@@ -0,0 +1,132 @@
+package download
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3+build5", "1.2.3", 0},
+		{"1.0.0", "1.0.1", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-rc.1", "1.0.0-beta.11", 1},
+		{"0.0.1", "snapshot", 1},
+		{"build10", "build9", 1},
+		{"build-a", "build-b", -1},
+	}
+	for _, c := range cases {
+		if r := compareVersions(c.a, c.b); r != c.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", c.a, c.b, r, c.expected)
+		}
+		if r := compareVersions(c.b, c.a); r != -c.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", c.b, c.a, r, -c.expected)
+		}
+	}
+}
+
+func TestVersionOrder(t *testing.T) {
+	VersionOrder("reversed", func(a, b string) int { return -compareVersions(a, b) * 10 })
+	defer delete(versionOrders, "reversed")
+
+	if r := compareIn("reversed", "1.0.0", "2.0.0"); r <= 0 {
+		t.Errorf("Version order of repo is not used, compareIn returned %d", r)
+	}
+	if r := compare("reversed", "version", "1.0.0", "2.0.0"); r <= 0 {
+		t.Errorf("Version order of repo is not used, compare returned %d", r)
+	}
+	if r := compareIn("raw", "1.0.0", "2.0.0"); r >= 0 {
+		t.Errorf("Repo without own order is not compared by semver, compareIn returned %d", r)
+	}
+}
+
+func TestConstraints(t *testing.T) {
+	cases := []struct {
+		constraint string
+		version    string
+		expected   bool
+	}{
+		{"^1.4", "1.4.0", true},
+		{"^1.4", "1.9.3", true},
+		{"^1.4", "2.0.0", false},
+		{"^1.4", "1.3.9", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"~2.0.3", "2.0.9", true},
+		{"~2.0.3", "2.1.0", false},
+		{"~2", "2.9.0", true},
+		{"1.2.x", "1.2.7", true},
+		{"1.2.*", "1.3.0", false},
+		{"1.x", "1.99.0", true},
+		{"*", "3.0.0", true},
+		{">=1.0 <2.0", "1.5.0", true},
+		{">=1.0 <2.0", "2.0.0", false},
+		{">=1.0, <2.0", "0.9.0", false},
+		{">= 1.0", "1.0.0", true},
+		{">= 1.0", "0.9.9", false},
+		{">= 1.0 < 2.0", "1.5.0", true},
+		{">= 1.0 < 2.0", "2.1.0", false},
+		{"> 1.0 || < 0.5", "0.1.0", true},
+		{"> 1.0 || < 0.5", "0.7.0", false},
+		{">1.2", "1.2.5", false},
+		{">1.2", "1.3.0", true},
+		{"<=1.2", "1.2.9", true},
+		{"<=1.2", "1.3.0", false},
+		{"1.0 - 1.4", "1.4.9", true},
+		{"1.0 - 1.4", "1.5.0", false},
+		{"1.0 - 1.4", "0.9.0", false},
+		{"=1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"^1.0", "1.5.0-beta", false},
+		{">=1.5.0-alpha", "1.5.0-beta", true},
+		{">=1.5.0-alpha", "1.6.0-beta", false},
+		{"^1.0", "snapshot", false},
+	}
+	for _, c := range cases {
+		con, err := parseConstraint(c.constraint)
+		if err != nil {
+			t.Errorf("parseConstraint(%q) returned error %v", c.constraint, err)
+			continue
+		}
+		if r := con.match(c.version); r != c.expected {
+			t.Errorf("%q matches %q: %v, expected %v", c.version, c.constraint, r, c.expected)
+		}
+	}
+}
+
+func TestConstraintErrors(t *testing.T) {
+	for _, s := range []string{"^1.2.3.4", "~a.b", ">=1.x.3", "!1.0"} {
+		if _, err := parseConstraint(s); err == nil {
+			t.Errorf("parseConstraint(%q) succeeded", s)
+		}
+	}
+}
+
+func TestMatchVersion(t *testing.T) {
+	cases := []struct {
+		version, requested string
+		expected           bool
+	}{
+		{"1.0.0", "", true},
+		{"1.0.0", "1.0.0", true},
+		{"1.0.1", "1.0.0", false},
+		{"latest", "latest", true},
+		{"1.4.2", "^1.4", true},
+		{"1.4.2", "^1.4 ||", true},
+		{"1.4.2", "^bad", false},
+	}
+	for _, c := range cases {
+		if r := matchVersion(c.version, c.requested); r != c.expected {
+			t.Errorf("matchVersion(%q, %q) = %v, expected %v", c.version, c.requested, r, c.expected)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package fsck checks consistency of stored files and DB records and optionally repairs found problems.
+package fsck
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/gorjun/config"
+	"github.com/subutai-io/gorjun/db"
+	"github.com/subutai-io/gorjun/storage"
+)
+
+// grace is age of stored files which may still be waiting for their records, e.g. just imported uploads
+const grace = time.Hour
+
+// blobName matches storage keys of artifacts: md5 sums and IDs of legacy records. Other files,
+// like apt indexes of old layout, are not considered orphans.
+var blobName = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+
+// Check looks for stored files without records, records with missing files, stale index entries
+// and drifted quota usage values. Stored files are also read to verify their hash sums if verify is set,
+// which is expensive for large or remote storage. It returns list of found problems, which are fixed if repair is set.
+func Check(repair, verify bool) (issues []string) {
+	issues = append(issues, orphans(repair)...)
+	issues = append(issues, records(repair, verify)...)
+	issues = append(issues, db.CheckIndex(repair)...)
+	for user, v := range db.QuotaUsageDrift() {
+		issues = append(issues, "Quota usage of "+user+" is "+strconv.Itoa(v[0])+", real value is "+strconv.Itoa(v[1]))
+	}
+	if repair {
+		db.QuotaUsageCorrect()
+	}
+	return issues
+}
+
+// orphans finds stored files which are not known to DB. DB is read before storage is listed, and files
+// imported shortly before that are skipped, as their blob records may be not written yet.
+func orphans(repair bool) (issues []string) {
+	snapshot := time.Now()
+	keys := db.StorageKeys()
+	list, err := storage.List("")
+	if log.Check(log.WarnLevel, "Listing stored files", err) {
+		return []string{"Failed to list stored files: " + err.Error()}
+	}
+	for _, v := range list {
+		if keys[v.Key] || !blobName.MatchString(v.Key) || v.ModTime.After(snapshot.Add(-grace)) {
+			continue
+		}
+		issues = append(issues, "Stored file "+v.Key+" has no record")
+		if repair {
+			log.Check(log.WarnLevel, "Removing "+v.Key+" from storage", storage.Delete(v.Key))
+		}
+	}
+	return issues
+}
+
+// records finds records which files are missing or, if sums are checked, have different hash sums.
+// Records of missing files are kept if CDN node is configured, as such files may be served by it.
+func records(repair, sums bool) (issues []string) {
+	checked := make(map[string]string)
+	for _, id := range db.Records() {
+		key, sum := db.RecordBlob(id)
+		if _, err := storage.Stat(key); err != nil {
+			info := db.Info(id)
+			if len(info["size"]) == 0 && len(info["Size"]) == 0 {
+				// record does not describe stored file
+				continue
+			}
+			issues = append(issues, "File "+key+" of record "+id+" ("+info["name"]+") is missing")
+			if repair && len(config.CDN.Node) == 0 {
+				db.Purge(id)
+			}
+			continue
+		}
+		if !sums {
+			continue
+		}
+		if _, ok := checked[key]; !ok {
+			checked[key] = verify(key, sum)
+		}
+		if problem := checked[key]; len(problem) != 0 {
+			issues = append(issues, "File "+key+" of record "+id+" "+problem)
+			if repair {
+				db.Purge(id)
+			}
+		}
+	}
+	return issues
+}
+
+// verify reads stored file and compares it with its key, if the key is md5 sum, and with expected sha256 sum
+func verify(key, sum string) string {
+	f, err := storage.Get(key)
+	if err != nil {
+		return "can not be read: " + err.Error()
+	}
+	defer f.Close()
+	md5h, sha256h := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5h, sha256h), f); err != nil {
+		return "can not be read: " + err.Error()
+	}
+	if len(key) == 32 && fmt.Sprintf("%x", md5h.Sum(nil)) != key {
+		return "has wrong md5 sum"
+	}
+	if len(sum) != 0 && fmt.Sprintf("%x", sha256h.Sum(nil)) != sum {
+		return "has wrong sha256 sum"
+	}
+	return ""
+}
+
+// Schedule runs check periodically with configured interval, repairing problems if it is enabled in configuration
+func Schedule() {
+	interval := config.FsckInterval()
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		issues := Check(config.Storage.Fsckrepair, config.Storage.Fsckverify)
+		for _, v := range issues {
+			log.Warn("fsck: " + v)
+		}
+		log.Info("fsck: " + strconv.Itoa(len(issues)) + " problems found")
+	}
+}
+
+// Handler runs check on request of administrator and returns list of found problems.
+// Problems are fixed if "repair" is set, and hash sums are verified if "verify" is set.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	issues := Check(r.FormValue("repair") == "true", r.FormValue("verify") == "true")
+	if issues == nil {
+		issues = []string{}
+	}
+	js, _ := json.Marshal(issues)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
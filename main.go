@@ -1,9 +1,14 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/subutai-io/agent/log"
@@ -12,6 +17,7 @@ import (
 	"github.com/subutai-io/gorjun/auth"
 	"github.com/subutai-io/gorjun/config"
 	"github.com/subutai-io/gorjun/db"
+	"github.com/subutai-io/gorjun/fsck"
 	"github.com/subutai-io/gorjun/raw"
 	"github.com/subutai-io/gorjun/template"
 	"github.com/subutai-io/gorjun/upload"
@@ -24,6 +30,18 @@ func main() {
 	// defer torrent.Close()
 	// go torrent.SeedLocal()
 
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		checkStorage(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		grantAdmin(os.Args[2:])
+		return
+	}
+	go upload.Expire()
+	go auth.Expire()
+	go fsck.Schedule()
+
 	if len(config.CDN.Node) > 0 {
 		target := url.URL{Scheme: "https", Host: config.CDN.Node}
 		proxy := httputil.NewSingleHostReverseProxy(&target)
@@ -46,55 +64,110 @@ func main() {
 		log.Check(log.ErrorLevel, "Starting to listen :"+config.Network.Port, http.ListenAndServe(":"+config.Network.Port, proxy))
 		return
 	}
-	http.HandleFunc("/kurjun/rest/file/get", raw.Download)
-	http.HandleFunc("/kurjun/rest/file/info", raw.Info)
-	http.HandleFunc("/kurjun/rest/raw/get", raw.Download)
-	http.HandleFunc("/kurjun/rest/template/get", template.Download)
-
-	http.HandleFunc("/kurjun/rest/apt/", apt.Download)
-	http.HandleFunc("/kurjun/rest/apt/info", apt.Info)
-	http.HandleFunc("/kurjun/rest/apt/list", apt.Info)
-	http.HandleFunc("/kurjun/rest/apt/delete", apt.Delete)
-	http.HandleFunc("/kurjun/rest/apt/upload", apt.Upload)
-	http.HandleFunc("/kurjun/rest/apt/download", apt.Download)
-
-	http.HandleFunc("/kurjun/rest/raw/", raw.Download)
-	http.HandleFunc("/kurjun/rest/raw/info", raw.Info)
-	http.HandleFunc("/kurjun/rest/raw/list", raw.Info)
-	http.HandleFunc("/kurjun/rest/raw/delete", raw.Delete)
-	http.HandleFunc("/kurjun/rest/raw/upload", raw.Upload)
-	http.HandleFunc("/kurjun/rest/raw/download", raw.Download)
-
-	http.HandleFunc("/kurjun/rest/template/", template.Download)
-	http.HandleFunc("/kurjun/rest/template/tag", template.Tag)
-	http.HandleFunc("/kurjun/rest/template/info", template.Info)
-	http.HandleFunc("/kurjun/rest/template/list", template.Info)
-	http.HandleFunc("/kurjun/rest/template/delete", template.Delete)
-	http.HandleFunc("/kurjun/rest/template/upload", template.Upload)
-	http.HandleFunc("/kurjun/rest/template/download", template.Download)
+	http.HandleFunc("/kurjun/rest/file/get", auth.Require("read", raw.Download))
+	http.HandleFunc("/kurjun/rest/file/info", auth.Require("read", raw.Info))
+	http.HandleFunc("/kurjun/rest/raw/get", auth.Require("read", raw.Download))
+	http.HandleFunc("/kurjun/rest/template/get", auth.Require("read", template.Download))
+
+	http.HandleFunc("/kurjun/rest/apt/", auth.Require("read", apt.Download))
+	http.HandleFunc("/kurjun/rest/apt/info", auth.Require("read", apt.Info))
+	http.HandleFunc("/kurjun/rest/apt/list", auth.Require("read", apt.Info))
+	http.HandleFunc("/kurjun/rest/apt/delete", auth.Require("delete", apt.Delete))
+	http.HandleFunc("/kurjun/rest/apt/upload", auth.Require("upload", apt.Upload))
+	http.HandleFunc("/kurjun/rest/apt/reindex", auth.Require("admin", apt.Reindex))
+	http.HandleFunc("/kurjun/rest/apt/download", auth.Require("read", apt.Download))
+
+	http.HandleFunc("/kurjun/rest/raw/", auth.Require("read", raw.Download))
+	http.HandleFunc("/kurjun/rest/raw/info", auth.Require("read", raw.Info))
+	http.HandleFunc("/kurjun/rest/raw/list", auth.Require("read", raw.Info))
+	http.HandleFunc("/kurjun/rest/raw/delete", auth.Require("delete", raw.Delete))
+	http.HandleFunc("/kurjun/rest/raw/upload", auth.Require("upload", raw.Upload))
+	http.HandleFunc("/kurjun/rest/raw/download", auth.Require("read", raw.Download))
+
+	http.HandleFunc("/kurjun/rest/template/", auth.Require("read", template.Download))
+	http.HandleFunc("/kurjun/rest/template/tag", auth.Require("upload", template.Tag))
+	http.HandleFunc("/kurjun/rest/template/info", auth.Require("read", template.Info))
+	http.HandleFunc("/kurjun/rest/template/list", auth.Require("read", template.Info))
+	http.HandleFunc("/kurjun/rest/template/delete", auth.Require("delete", template.Delete))
+	http.HandleFunc("/kurjun/rest/template/upload", auth.Require("upload", template.Upload))
+	http.HandleFunc("/kurjun/rest/template/download", auth.Require("read", template.Download))
 	// http.HandleFunc("/kurjun/rest/template/torrent", template.Torrent)
 
 	http.HandleFunc("/kurjun/rest/auth/key", auth.Key)
 	http.HandleFunc("/kurjun/rest/auth/keys", auth.Keys)
-	http.HandleFunc("/kurjun/rest/auth/sign", auth.Sign)
+	http.HandleFunc("/kurjun/rest/auth/sign", auth.Require("upload", auth.Sign))
 	http.HandleFunc("/kurjun/rest/auth/token", auth.Token)
 	http.HandleFunc("/kurjun/rest/auth/register", auth.Register)
 	http.HandleFunc("/kurjun/rest/auth/validate", auth.Validate)
+	http.HandleFunc("/kurjun/rest/auth/tokens", auth.Tokens)
+	http.HandleFunc("/kurjun/rest/auth/deploykeys", auth.Require("upload", auth.DeployKeys))
+	http.HandleFunc("/kurjun/rest/auth/publishers", auth.Require("admin", auth.Publishers, "POST", "DELETE"))
+	http.HandleFunc("/kurjun/rest/auth/roles", auth.Require("admin", auth.Roles, "POST", "DELETE"))
+	http.HandleFunc("/kurjun/rest/auth/orgs", auth.Require("share", auth.Orgs, "POST", "DELETE"))
+
+	http.HandleFunc("/kurjun/rest/upload/start", auth.Require("upload", upload.Start))
+	http.HandleFunc("/kurjun/rest/upload/chunk", auth.Require("upload", upload.Chunk))
+	http.HandleFunc("/kurjun/rest/upload/status", auth.Require("upload", upload.Status))
 
-	http.HandleFunc("/kurjun/rest/share", upload.Share)
-	http.HandleFunc("/kurjun/rest/quota", upload.Quota)
-	http.HandleFunc("/kurjun/rest/about", about)
+	http.HandleFunc("/kurjun/rest/share", auth.Require("share", upload.Share))
+	http.HandleFunc("/kurjun/rest/transfer", auth.Require("upload", upload.Transfer))
+	http.HandleFunc("/kurjun/rest/alias", auth.Require("upload", upload.Alias, "POST", "DELETE"))
+	http.HandleFunc("/kurjun/rest/quota", auth.Require("quota", upload.Quota, "POST"))
+	http.HandleFunc("/kurjun/rest/about", auth.Require("admin", about))
+	http.HandleFunc("/kurjun/rest/fsck", auth.Require("admin", fsck.Handler))
 
 	log.Check(log.ErrorLevel, "Starting to listen :"+config.Network.Port, http.ListenAndServe(":"+config.Network.Port, nil))
 }
 
 func about(w http.ResponseWriter, r *http.Request) {
-	if strings.Split(r.RemoteAddr, ":")[0] == "127.0.0.1" {
-		_, err := w.Write([]byte(version))
-		log.Check(log.DebugLevel, "Writing Kurjun version", err)
-	} else {
-		w.WriteHeader(http.StatusUnauthorized)
+	_, err := w.Write([]byte(version))
+	log.Check(log.DebugLevel, "Writing Kurjun version", err)
+}
+
+// checkStorage runs storage consistency check from command line: gorjun fsck [-repair] [-verify].
+// It opens DB directly, so it works only while server is stopped. Running server is checked by
+// POST request to /kurjun/rest/fsck.
+func checkStorage(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix found problems")
+	verify := flags.Bool("verify", false, "read stored files and verify their hash sums")
+	flags.Parse(args)
+
+	issues := fsck.Check(*repair, *verify)
+	for _, v := range issues {
+		fmt.Println(v)
+	}
+	fmt.Println(strconv.Itoa(len(issues)) + " problems found")
+	if len(issues) != 0 && !*repair {
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+// grantAdmin grants administrator role from command line, registering user if key file is specified:
+// gorjun admin [-key <file>] <name>. It is the way to bootstrap the first administrator, and it should
+// be run while server is stopped, as DB can not be opened by two processes.
+func grantAdmin(args []string) {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	keyfile := flags.String("key", "", "file with PGP public key of user to register")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: gorjun admin [-key <file>] <name>")
+		db.Close()
+		os.Exit(1)
+	}
+	name := flags.Arg(0)
+	if len(*keyfile) != 0 {
+		key, err := ioutil.ReadFile(*keyfile)
+		if err != nil {
+			fmt.Println("Reading key: " + err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+		db.RegisterUser([]byte(name), key)
 	}
+	db.GrantRole(name, "admin")
+	fmt.Println("Role admin granted to " + name)
 }
 
 func singleJoiningSlash(a, b string) string {
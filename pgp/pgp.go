@@ -2,11 +2,14 @@ package pgp
 
 import (
 	"bytes"
+	"fmt"
+	"os"
 
 	"github.com/subutai-io/agent/log"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/clearsign"
 
+	"github.com/subutai-io/gorjun/config"
 	"github.com/subutai-io/gorjun/db"
 )
 
@@ -34,3 +37,65 @@ func Fingerprint(key string) []byte {
 	}
 	return []byte("")
 }
+
+// signer reads server private key from file specified in config and decrypts it if passphrase is set
+func signer() (*openpgp.Entity, error) {
+	if len(config.PGP.Key) == 0 {
+		return nil, fmt.Errorf("Server signing key is not configured")
+	}
+	f, err := os.Open(config.PGP.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if err = entity.PrivateKey.Decrypt([]byte(config.PGP.Passphrase)); err != nil {
+				return nil, err
+			}
+		}
+		return entity, nil
+	}
+	return nil, fmt.Errorf("No private key found in %s", config.PGP.Key)
+}
+
+// ClearSign returns message wrapped into clearsigned block made by server key
+func ClearSign(message []byte) ([]byte, error) {
+	entity, err := signer()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	w, err := clearsign.Encode(&out, entity.PrivateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(message); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// DetachSign returns armored detached signature of message made by server key
+func DetachSign(message []byte) ([]byte, error) {
+	entity, err := signer()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&out, entity, bytes.NewReader(message), nil); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
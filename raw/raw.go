@@ -14,29 +14,28 @@ import (
 
 func Upload(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		md5, sha256, owner := upload.Handler(w, r)
-		if len(md5) == 0 || len(sha256) == 0 {
+		sums, owner := upload.Handler(w, r)
+		defer upload.Release(owner, sums)
+		if len(sums.Md5) == 0 || len(sums.Sha256) == 0 {
 			return
 		}
 		info := map[string]string{
-			"md5":    md5,
-			"sha256": sha256,
+			"md5":    sums.Md5,
+			"sha256": sums.Sha256,
 			"type":   "raw",
 		}
-		r.ParseMultipartForm(32 << 20)
-		if len(r.MultipartForm.Value["version"]) != 0 {
-			info["version"] = r.MultipartForm.Value["version"][0]
+		if len(r.FormValue("version")) != 0 {
+			info["version"] = r.FormValue("version")
 		}
-		_, header, _ := r.FormFile("file")
 		id := uuid.NewV4().String()
-		db.Write(owner, id, header.Filename, info)
-		if len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true" {
-			log.Info("Sharing " + md5 + " with " + owner)
+		db.Write(owner, id, sums.Name, info)
+		if r.FormValue("private") == "true" {
+			log.Info("Sharing " + sums.Md5 + " with " + owner)
 			db.ShareWith(id, owner, owner)
 		}
 
 		w.Write([]byte(id))
-		log.Info(header.Filename + " saved to raw repo by " + owner)
+		log.Info(sums.Name + " saved to raw repo by " + owner)
 	}
 }
 
@@ -52,6 +51,8 @@ func Download(w http.ResponseWriter, r *http.Request) {
 	if len(args) > 1 {
 		if list := db.UserFile(args[0], args[1]); len(list) > 0 {
 			http.Redirect(w, r, "/kurjun/rest/raw/download?id="+list[0], 302)
+		} else if id := db.Alias(args[0], "raw", args[1]); len(id) != 0 {
+			http.Redirect(w, r, "/kurjun/rest/raw/download?id="+id, 302)
 		}
 	}
 }
@@ -69,6 +70,13 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 }
 
 func Info(w http.ResponseWriter, r *http.Request) {
+	if download.Paginated(r) {
+		download.Page("raw", w, r)
+		return
+	}
+	if !download.CheckQuery(w, r) {
+		return
+	}
 	info := download.Info("raw", r)
 	if len(info) == 0 {
 		w.WriteHeader(http.StatusNotFound)
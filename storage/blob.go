@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// Blob is a seekable reader of stored blob. Data is requested from backend lazily starting from current
+// position, so seeking does not cause transfer of skipped parts.
+type Blob struct {
+	key  string
+	size int64
+	pos  int64
+	r    io.ReadCloser
+}
+
+// Open returns seekable reader of blob and information about it
+func Open(key string) (*Blob, Info, error) {
+	info, err := backend.Stat(key)
+	if err != nil {
+		return nil, info, err
+	}
+	return &Blob{key: key, size: info.Size}, info, nil
+}
+
+// Read reads data from current position of blob
+func (b *Blob) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if b.r == nil {
+		r, err := backend.GetRange(b.key, b.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.r = r
+	}
+	n, err := b.r.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+// Seek sets position for next Read
+func (b *Blob) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += b.pos
+	case io.SeekEnd:
+		pos += b.size
+	}
+	if pos < 0 {
+		return b.pos, errors.New("Negative position")
+	}
+	if pos != b.pos {
+		b.Close()
+		b.pos = pos
+	}
+	return pos, nil
+}
+
+// Close releases connection to backend, Blob may be read again after seeking
+func (b *Blob) Close() error {
+	if b.r == nil {
+		return nil
+	}
+	err := b.r.Close()
+	b.r = nil
+	return err
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// local keeps blobs as plain files in a single directory
+type local struct {
+	root string
+}
+
+// path returns location of blob on disk. Keys are not allowed to point outside of storage directory.
+func (l *local) path(key string) (string, error) {
+	if len(key) == 0 || strings.ContainsAny(key, "/\\") || strings.HasPrefix(key, ".") {
+		return "", &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	return l.root + key, nil
+}
+
+func (l *local) Put(key string, r io.Reader, size int64) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(l.root, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (l *local) Get(key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// section limits reading of file, but closes the file itself
+type section struct {
+	io.Reader
+	io.Closer
+}
+
+func (l *local) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return section{io.LimitReader(f, length), f}, nil
+}
+
+func (l *local) Stat(key string) (Info, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (l *local) Delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// List returns regular files of storage directory. Subdirectories, e.g. apt indexes, and hidden temporary files are skipped.
+func (l *local) List(prefix string) (list []Info, err error) {
+	files, err := ioutil.ReadDir(l.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") && strings.HasPrefix(fi.Name(), prefix) {
+			list = append(list, Info{Key: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+	}
+	return list, nil
+}
+
+// Import moves file into storage directory, falling back to copying if file is located on another device.
+// Modification time of moved file is set to import time, as consistency check relies on it to skip fresh files.
+func (l *local) Import(key, path string) error {
+	dst, err := l.path(key)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	if os.Rename(path, dst) == nil {
+		return nil
+	}
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return l.Put(key, f, -1)
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3 keeps blobs in a bucket of S3-compatible object storage (AWS S3, MinIO, Ceph RGW etc.).
+// Requests use path-style addressing and are signed with AWS Signature Version 4.
+// Payload is not signed, so large blobs are streamed without additional pass over data.
+type s3 struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	access   string
+	secret   string
+	client   *http.Client
+}
+
+func newS3(endpoint, region, bucket, access, secret string) (*s3, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Endpoint must be an absolute URL, e.g. https://s3.amazonaws.com")
+	}
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("Bucket is not specified")
+	}
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+	return &s3{endpoint: u, region: region, bucket: bucket, access: access, secret: secret, client: &http.Client{}}, nil
+}
+
+// escape encodes string according to RFC 3986, as required by Signature Version 4
+func escape(s string, slash bool) string {
+	var buf strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds Signature Version 4 authorization headers to request
+func (s *s3) sign(req *http.Request, path string, query url.Values) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, escape(k, true)+"="+escape(v, true))
+		}
+	}
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		escape(path, false),
+		strings.Join(params, "&"),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+			"x-amz-date:" + req.Header.Get("X-Amz-Date") + "\n",
+		signed,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secret), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.access+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+// do sends signed request for object with key, or for the bucket itself if key is empty
+func (s *s3) do(method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	path := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket
+	if len(key) != 0 {
+		path += "/" + key
+	}
+	u := *s.endpoint
+	u.Path = path
+	u.RawPath = escape(path, false)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, path, query)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s %s", method, key, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// Put uploads blob with single request. Size must be known in advance.
+func (s *s3) Put(key string, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("S3 storage requires size of %s", key)
+	}
+	resp, err := s.do(http.MethodPut, key, nil, r, size, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	rng := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	if length >= 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := s.do(http.MethodGet, key, nil, nil, 0, http.Header{"Range": {rng}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3) Stat(key string) (Info, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	modified, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	return Info{Key: key, Size: resp.ContentLength, ModTime: modified}, nil
+}
+
+func (s *s3) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listResult is a response of ListObjectsV2 request
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3) List(prefix string) (list []Info, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range result.Contents {
+			list = append(list, Info{Key: v.Key, Size: v.Size, ModTime: v.LastModified})
+		}
+		if !result.IsTruncated {
+			return list, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccess = "minioadmin"
+	testSecret = "miniosecret"
+	testRegion = "eu-west-1"
+	testBucket = "gorjun"
+)
+
+// fakeS3 is a minimal stand-in of S3-compatible server, like MinIO. It keeps objects in memory
+// and checks Signature Version 4 of every request the same way as real server does.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	pageLen int
+}
+
+func sum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by name, with spaces as %20
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for k, list := range query {
+		for _, v := range list {
+			params = append(params, strings.Replace(url.QueryEscape(k)+"="+url.QueryEscape(v), "+", "%20", -1))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// authorized recomputes request signature and compares it with the one from Authorization header
+func (f *fakeS3) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	date := r.Header.Get("X-Amz-Date")
+	if len(date) < 8 || r.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+		return false
+	}
+	scope := date[:8] + "/" + testRegion + "/s3/aws4_request"
+	canonical := r.Method + "\n" + r.URL.EscapedPath() + "\n" + canonicalQuery(r.URL.Query()) + "\n" +
+		"host:" + r.Host + "\n" + "x-amz-content-sha256:UNSIGNED-PAYLOAD\n" + "x-amz-date:" + date + "\n\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" + "UNSIGNED-PAYLOAD"
+	hash := sha256.Sum256([]byte(canonical))
+	key := sum(sum(sum(sum([]byte("AWS4"+testSecret), date[:8]), testRegion), "s3"), "aws4_request")
+	signature := hex.EncodeToString(sum(key, "AWS4-HMAC-SHA256\n"+date+"\n"+scope+"\n"+hex.EncodeToString(hash[:])))
+	return auth == "AWS4-HMAC-SHA256 Credential="+testAccess+"/"+scope+
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="+signature
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>SignatureDoesNotMatch</Code></Error>"))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+testBucket+"/") && r.URL.Path != "/"+testBucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+testBucket), "/")
+
+	f.Lock()
+	defer f.Unlock()
+	if len(key) == 0 && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, r.URL.Query())
+		return
+	}
+	data, ok := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		if int64(len(body)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case http.MethodGet, http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if rng := r.Header.Get("Range"); len(rng) != 0 {
+			bounds := strings.Split(strings.TrimPrefix(rng, "bytes="), "-")
+			start, _ := strconv.Atoi(bounds[0])
+			end := len(data) - 1
+			if len(bounds[1]) != 0 {
+				end, _ = strconv.Atoi(bounds[1])
+			}
+			data = data[start : end+1]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list responds to ListObjectsV2 request, splitting result into pages of pageLen objects
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, query.Get("prefix")) && k > query.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type object struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	if len(keys) > f.pageLen {
+		keys = keys[:f.pageLen]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		result.Contents = append(result.Contents, object{Key: k, Size: int64(len(f.objects[k])), LastModified: time.Now().UTC()})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func testS3(t *testing.T, secret string) (*s3, *fakeS3, func()) {
+	fake := &fakeS3{objects: make(map[string][]byte), pageLen: 2}
+	server := httptest.NewServer(fake)
+	s, err := newS3(server.URL, testRegion, testBucket, testAccess, secret)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return s, fake, server.Close
+}
+
+func TestS3Blobs(t *testing.T) {
+	s, fake, done := testS3(t, testSecret)
+	defer done()
+
+	blobs := map[string]string{
+		"0123abcd":                   "first blob",
+		"0123abce":                   "second blob",
+		"0124":                       "third blob",
+		"dir/name with spaces+plus~": "escaped key",
+	}
+	for k, v := range blobs {
+		if err := s.Put(k, strings.NewReader(v), int64(len(v))); err != nil {
+			t.Fatalf("Put %q: %v", k, err)
+		}
+	}
+	if len(fake.objects) != len(blobs) {
+		t.Fatalf("Server has %d objects, expected %d", len(fake.objects), len(blobs))
+	}
+
+	for k, v := range blobs {
+		r, err := s.Get(k)
+		if err != nil {
+			t.Fatalf("Get %q: %v", k, err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != v {
+			t.Errorf("Get %q returned %q, expected %q", k, data, v)
+		}
+		info, err := s.Stat(k)
+		if err != nil || info.Size != int64(len(v)) || info.ModTime.IsZero() {
+			t.Errorf("Stat %q returned %+v, %v", k, info, err)
+		}
+	}
+
+	ranges := []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, 5, "first"},
+		{6, 4, "blob"},
+		{6, -1, "blob"},
+		{3, 1, "s"},
+	}
+	for _, c := range ranges {
+		r, err := s.GetRange("0123abcd", c.offset, c.length)
+		if err != nil {
+			t.Fatalf("GetRange %d %d: %v", c.offset, c.length, err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != c.expected {
+			t.Errorf("GetRange %d %d returned %q, expected %q", c.offset, c.length, data, c.expected)
+		}
+	}
+
+	prefixes := []struct {
+		prefix string
+		keys   []string
+	}{
+		{"", []string{"0123abcd", "0123abce", "0124", "dir/name with spaces+plus~"}},
+		{"0123", []string{"0123abcd", "0123abce"}},
+		{"dir/", []string{"dir/name with spaces+plus~"}},
+		{"none", nil},
+	}
+	for _, c := range prefixes {
+		list, err := s.List(c.prefix)
+		if err != nil {
+			t.Fatalf("List %q: %v", c.prefix, err)
+		}
+		var keys []string
+		for _, v := range list {
+			keys = append(keys, v.Key)
+			if v.Size != int64(len(blobs[v.Key])) {
+				t.Errorf("List %q returned size %d of %q", c.prefix, v.Size, v.Key)
+			}
+		}
+		if strings.Join(keys, ",") != strings.Join(c.keys, ",") {
+			t.Errorf("List %q returned %q, expected %q", c.prefix, keys, c.keys)
+		}
+	}
+
+	if err := s.Delete("0124"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get("0124"); !os.IsNotExist(err) {
+		t.Errorf("Get of deleted blob returned %v, expected not exist error", err)
+	}
+	if _, err := s.Stat("0124"); !os.IsNotExist(err) {
+		t.Errorf("Stat of deleted blob returned %v, expected not exist error", err)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	s, fake, done := testS3(t, "wrong secret")
+	defer done()
+
+	if err := s.Put("key", strings.NewReader("data"), 4); err == nil || os.IsNotExist(err) {
+		t.Errorf("Put with wrong secret returned %v, expected signature error", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("Object is stored with wrong signature")
+	}
+	if err := s.Put("key", strings.NewReader("data"), -1); err == nil {
+		t.Errorf("Put of unknown size succeeded")
+	}
+
+	for _, endpoint := range []string{"", "s3.amazonaws.com", "://bad"} {
+		if _, err := newS3(endpoint, "", testBucket, testAccess, testSecret); err == nil {
+			t.Errorf("Endpoint %q is accepted", endpoint)
+		}
+	}
+	if _, err := newS3("https://s3.amazonaws.com", "", "", testAccess, testSecret); err == nil {
+		t.Errorf("Empty bucket is accepted")
+	}
+}
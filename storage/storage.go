@@ -0,0 +1,115 @@
+// Package storage provides access to artifact blobs. Blobs are addressed by keys (hash sums of files)
+// and may be kept on local disk or in S3-compatible object storage, depending on configuration.
+package storage
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/config"
+)
+
+// Info describes stored blob
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is a blob storage. Missing blobs are reported with errors satisfying os.IsNotExist.
+type Backend interface {
+	// Put stores size bytes from r under key, replacing existing blob
+	Put(key string, r io.Reader, size int64) error
+	// Get returns reader of whole blob
+	Get(key string) (io.ReadCloser, error)
+	// GetRange returns reader of length bytes of blob starting from offset. Negative length means till the end.
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+	// Stat returns information about blob
+	Stat(key string) (Info, error)
+	// Delete removes blob
+	Delete(key string) error
+	// List returns information about all blobs which keys start with prefix
+	List(prefix string) ([]Info, error)
+}
+
+// importer is implemented by backends which are able to take local file without copying it
+type importer interface {
+	Import(key, path string) error
+}
+
+var backend = initBackend()
+
+func initBackend() Backend {
+	switch config.Storage.Backend {
+	case "s3":
+		b, err := newS3(config.S3.Endpoint, config.S3.Region, config.S3.Bucket, config.S3.Accesskey, config.S3.Secretkey)
+		log.Check(log.FatalLevel, "Initializing S3 storage "+config.S3.Endpoint, err)
+		return b
+	case "", "local":
+		os.MkdirAll(config.Storage.Path, 0755)
+		return &local{root: config.Storage.Path}
+	}
+	log.Fatal("Unknown storage backend " + config.Storage.Backend)
+	return nil
+}
+
+// Put stores size bytes from r under key
+func Put(key string, r io.Reader, size int64) error {
+	return backend.Put(key, r, size)
+}
+
+// Get returns reader of blob
+func Get(key string) (io.ReadCloser, error) {
+	return backend.Get(key)
+}
+
+// GetRange returns reader of part of blob
+func GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	return backend.GetRange(key, offset, length)
+}
+
+// Stat returns information about blob
+func Stat(key string) (Info, error) {
+	return backend.Stat(key)
+}
+
+// Delete removes blob
+func Delete(key string) error {
+	return backend.Delete(key)
+}
+
+// List returns information about blobs which keys start with prefix
+func List(prefix string) ([]Info, error) {
+	return backend.List(prefix)
+}
+
+// Import moves local file to storage under key. Local file is removed in any case.
+func Import(key, path string) error {
+	if b, ok := backend.(importer); ok {
+		return b.Import(key, path)
+	}
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return backend.Put(key, f, fi.Size())
+}
+
+// Size returns size of blob or -1 if it is not available
+func Size(key string) int64 {
+	if info, err := backend.Stat(key); err == nil {
+		return info.Size
+	}
+	return -1
+}
@@ -6,7 +6,6 @@ import (
 	"compress/gzip"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/satori/go.uuid"
@@ -15,16 +14,18 @@ import (
 
 	"fmt"
 
-	"github.com/subutai-io/gorjun/config"
 	"github.com/subutai-io/gorjun/db"
 	"github.com/subutai-io/gorjun/download"
+	"github.com/subutai-io/gorjun/storage"
 	"github.com/subutai-io/gorjun/upload"
 )
 
 func readTempl(hash string) (configfile string, err error) {
 	var file bytes.Buffer
-	f, err := os.Open(config.Storage.Path + hash)
-	log.Check(log.WarnLevel, "Opening file "+config.Storage.Path+hash, err)
+	f, err := storage.Get(hash)
+	if log.Check(log.WarnLevel, "Opening file "+hash, err) {
+		return "", err
+	}
 	defer f.Close()
 
 	gzf, err := gzip.NewReader(f)
@@ -77,35 +78,38 @@ func getConf(hash string, configfile string) (t *download.ListItem) {
 
 func Upload(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		md5, sha256, owner := upload.Handler(w, r)
-		if len(md5) == 0 || len(sha256) == 0 {
+		sums, owner := upload.Handler(w, r)
+		defer upload.Release(owner, sums)
+		if len(sums.Md5) == 0 || len(sums.Sha256) == 0 {
 			return
 		}
+		md5 := sums.Md5
 		configfile, err := readTempl(md5)
 		if err != nil || len(configfile) == 0 {
 			log.Warn("Unable to read template config")
 			w.WriteHeader(http.StatusNotAcceptable)
 			w.Write([]byte("Unable to read configuration file. Is it a template archive?"))
-			if db.Delete(owner, "template", md5) < 1 {
-				f, _ := os.Stat(config.Storage.Path + md5)
-				db.QuotaUsageSet(owner, -int(f.Size()))
-				os.Remove(config.Storage.Path + md5)
-			}
+			db.DropBlob(sums.Sha256)
 			return
 		}
 		t := getConf(md5, configfile)
-		db.Write(owner, t.ID, t.Name+"-subutai-template_"+t.Version+"_"+t.Architecture+".tar.gz", map[string]string{
+		name := t.Name + "-subutai-template_" + t.Version + "_" + t.Architecture + ".tar.gz"
+		if upload.Denied(w, r, name) {
+			db.DropBlob(sums.Sha256)
+			return
+		}
+		db.Write(owner, t.ID, name, map[string]string{
 			"type":        "template",
 			"arch":        t.Architecture,
 			"md5":         md5,
-			"sha256":      sha256,
+			"sha256":      sums.Sha256,
 			"tags":        strings.Join(t.Tags, ","),
 			"parent":      t.Parent,
 			"version":     t.Version,
 			"prefsize":    t.Prefsize,
 			"Description": t.Description,
 		})
-		if len(r.MultipartForm.Value["private"]) > 0 && r.MultipartForm.Value["private"][0] == "true" {
+		if r.FormValue("private") == "true" {
 			log.Info("Sharing " + t.ID + " with " + owner)
 			db.ShareWith(t.ID, owner, owner)
 		}
@@ -125,6 +129,8 @@ func Download(w http.ResponseWriter, r *http.Request) {
 	if len(args) > 1 {
 		if list := db.UserFile(args[0], args[1]); len(list) > 0 {
 			http.Redirect(w, r, "/kurjun/rest/template/download?id="+list[0], 302)
+		} else if id := db.Alias(args[0], "template", args[1]); len(id) != 0 {
+			http.Redirect(w, r, "/kurjun/rest/template/download?id="+id, 302)
 		}
 	}
 }
@@ -158,6 +164,13 @@ func Info(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Incorrect method"))
 		return
 	}
+	if download.Paginated(r) {
+		download.Page("template", w, r)
+		return
+	}
+	if !download.CheckQuery(w, r) {
+		return
+	}
 	if info := download.Info("template", r); len(info) > 2 {
 		w.Write(info)
 	} else {
@@ -211,7 +224,7 @@ func Tag(w http.ResponseWriter, r *http.Request) {
 
 func addTag(values map[string][]string) (int, error) {
 	if len(values["token"]) > 0 {
-		if user := db.CheckToken(values["token"][0]); len(values["token"][0]) == 0 || len(user) == 0 {
+		if user := db.CheckTokenScope(values["token"][0], "upload", "template"); len(values["token"][0]) == 0 || len(user) == 0 {
 			return http.StatusUnauthorized, fmt.Errorf("Failed to authorize using provided token")
 		} else if len(values["id"]) > 0 && len(values["tags"]) > 0 {
 			if db.CheckRepo(user, "template", values["id"][0]) > 0 {
@@ -225,7 +238,7 @@ func addTag(values map[string][]string) (int, error) {
 
 func delTag(values map[string][]string) (int, error) {
 	if len(values["token"]) > 0 {
-		if user := db.CheckToken(values["token"][0]); len(values["token"][0]) == 0 || len(user) == 0 {
+		if user := db.CheckTokenScope(values["token"][0], "upload", "template"); len(values["token"][0]) == 0 || len(user) == 0 {
 			return http.StatusUnauthorized, fmt.Errorf("Failed to authorize using provided token")
 		} else if len(values["id"]) > 0 && len(values["tags"]) > 0 {
 			if db.CheckRepo(user, "template", values["id"][0]) > 0 {
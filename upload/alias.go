@@ -0,0 +1,111 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+var aliasName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// Alias manages named pointers of owners to their artifacts, e.g. "stable" or "lts".
+// GET lists aliases of owner in repo, or returns alias with history of its moves if name is specified,
+// showing only artifacts visible for requester.
+// POST points alias to artifact of authorized user and DELETE removes it, aliases of organization
+// specified by "org" are managed by its owners and maintainers.
+func Alias(w http.ResponseWriter, r *http.Request) {
+	repo := r.FormValue("repo")
+	name := r.FormValue("name")
+	if repo != "raw" && repo != "template" && repo != "apt" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please specify repository"))
+		return
+	}
+
+	if r.Method == "GET" {
+		owner := strings.ToLower(r.URL.Query().Get("owner"))
+		if len(owner) == 0 {
+			owner = "subutai"
+		}
+		// IDs of artifacts which are not visible for requester are hidden
+		user := db.CheckTokenScope(r.FormValue("token"), "read", repo)
+		visible := func(id string) bool {
+			return len(id) == 0 || db.Public(id) || db.CheckShare(id, user)
+		}
+		list := db.Aliases(owner, repo)
+		for k, id := range list {
+			if !visible(id) {
+				delete(list, k)
+			}
+		}
+		var js []byte
+		if len(name) != 0 {
+			history := db.AliasHistory(owner, repo, name)
+			for _, v := range history {
+				if !visible(v["id"]) {
+					v["id"] = ""
+				}
+				if !visible(v["previous"]) {
+					v["previous"] = ""
+				}
+			}
+			js, _ = json.Marshal(map[string]interface{}{
+				"name":    name,
+				"id":      list[name],
+				"history": history,
+			})
+		} else {
+			js, _ = json.Marshal(list)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	} else if r.Method != "POST" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+
+	user := strings.ToLower(db.CheckTokenScope(r.FormValue("token"), "upload", repo))
+	if len(user) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+	owner := onBehalf(w, r, user)
+	if len(owner) == 0 {
+		return
+	}
+	if !aliasName.MatchString(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid alias name"))
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if _, ok := db.Aliases(owner, repo)[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Alias not found"))
+			return
+		}
+		db.SetAlias(owner, repo, name, "", user)
+		log.Info("Alias " + name + " of " + owner + " removed")
+		w.Write([]byte("Removed"))
+		return
+	}
+
+	id := r.FormValue("id")
+	if len(id) == 0 || db.CheckRepo(owner, repo, id) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("File is not owned by authorized user"))
+		return
+	}
+	db.SetAlias(owner, repo, name, id, user)
+	log.Info("Alias " + name + " of " + owner + " points to " + id)
+	w.Write([]byte("Ok"))
+}
@@ -0,0 +1,58 @@
+package upload
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/subutai-io/agent/log"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// allows checks if deploy key gives access to repo and to artifact with specified file name.
+// Empty name is not checked.
+func allows(key map[string]string, repo, name string) bool {
+	if key == nil || len(key["repos"]) != 0 && !in(repo, strings.Split(key["repos"], ",")) {
+		return false
+	}
+	if len(name) == 0 || len(key["patterns"]) == 0 {
+		return true
+	}
+	for _, pattern := range strings.Split(key["patterns"], ",") {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// denied checks if deploy key used for request gives no access to artifact, writing error response in that case
+func denied(w http.ResponseWriter, r *http.Request, key map[string]string, name string) bool {
+	if key == nil || allows(key, repository(r), name) {
+		return false
+	}
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("Deploy key does not allow access to " + name))
+	log.Warn(r.RemoteAddr + " - deploy key " + key["name"] + " of " + key["owner"] + " does not allow access to " + name)
+	return true
+}
+
+// Denied checks if deploy key used for upload request gives no access to artifact stored under name,
+// which may differ from uploaded file name, e.g. name of template taken from its config. Error response is written in that case.
+func Denied(w http.ResponseWriter, r *http.Request, name string) bool {
+	token := r.Header.Get("token")
+	if len(db.CheckTokenScope(token, "upload", repository(r))) != 0 {
+		return false
+	}
+	return denied(w, r, db.DeployKey(token), name)
+}
+
+func in(str string, list []string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
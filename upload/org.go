@@ -0,0 +1,68 @@
+package upload
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/gorjun/db"
+)
+
+// onBehalf returns owner of uploaded files: organization specified by "org" parameter if user is its owner
+// or maintainer, or user itself otherwise. Empty string is returned and request is rejected if user can not
+// publish for organization.
+func onBehalf(w http.ResponseWriter, r *http.Request, user string) string {
+	org := strings.ToLower(r.FormValue("org"))
+	if len(org) == 0 {
+		return user
+	}
+	if !db.IsOrg(org) || !db.OrgMaintainer(org, user) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Not allowed to publish on behalf of " + org))
+		log.Warn("User " + user + " is not allowed to publish on behalf of " + org + ", rejecting request")
+		return ""
+	}
+	return org
+}
+
+// Transfer moves artifact to organization, so it stays managed when its uploader leaves. Artifact is moved
+// by its owner, or by maintainer of organization owning it, to organization maintained by requester.
+// Administrators may move artifact of any owner, specified by "from", to any user or organization.
+func Transfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Incorrect method"))
+		return
+	}
+	repo, id, to := r.FormValue("repo"), r.FormValue("id"), strings.ToLower(r.FormValue("to"))
+	token := r.FormValue("token")
+	user := strings.ToLower(db.CheckTokenScope(token, "upload", repo))
+	if len(user) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+	admin := db.Allowed(user, "admin") && len(db.CheckTokenScope(token, "admin", "")) != 0
+
+	from := db.ActingOwner(user, repo, id)
+	if admin && len(r.FormValue("from")) != 0 {
+		from = strings.ToLower(r.FormValue("from"))
+	}
+	if len(from) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("File is not owned by authorized user"))
+		return
+	}
+	if !admin && !db.OrgMaintainer(to, user) || admin && !db.IsOrg(to) && len(db.UserKeys(to)) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Not allowed to transfer artifacts to " + to))
+		return
+	}
+	if err := db.Transfer(id, repo, from, to); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Info("Artifact " + id + " in " + repo + " repo transferred from " + from + " to " + to + " by " + user)
+	w.Write([]byte("Ok"))
+}
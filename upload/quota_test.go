@@ -0,0 +1,60 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/gorjun/db"
+)
+
+// testUser registers user with default roles and 1000 bytes quota and issues token with all scopes
+func testUser(user string) string {
+	db.RegisterUser([]byte(user), []byte("key-of-"+user))
+	db.QuotaSet(user, "1000")
+	token := "token-of-" + user
+	db.SaveToken(user, fmt.Sprintf("%x", sha256.Sum256([]byte(token))), db.Scopes, "", time.Hour)
+	return token
+}
+
+func TestQuotaPermissions(t *testing.T) {
+	keeper, user := testUser("quota-keeper"), testUser("quota-user")
+	db.GrantRole("quota-keeper", "quota-manager")
+	defer db.RevokeRole("quota-keeper", "quota-manager")
+
+	cases := []struct {
+		name   string
+		method string
+		query  url.Values
+		code   int
+	}{
+		{"own usage", "GET", url.Values{"user": {"quota-user"}, "token": {user}}, http.StatusOK},
+		{"usage of another user", "GET", url.Values{"user": {"quota-keeper"}, "token": {user}}, http.StatusForbidden},
+		{"usage correction by user", "GET", url.Values{"user": {"quota-user"}, "token": {user}, "fix": {"1"}}, http.StatusForbidden},
+		{"usage correction of subutai by user", "GET", url.Values{"user": {"subutai"}, "token": {user}, "fix": {"1"}}, http.StatusForbidden},
+		{"usage correction by quota manager", "GET", url.Values{"user": {"quota-user"}, "token": {keeper}, "fix": {"1"}}, http.StatusOK},
+		{"quota change by user", "POST", url.Values{"user": {"quota-user"}, "token": {user}, "quota": {"-1"}}, http.StatusForbidden},
+		{"quota change by quota manager", "POST", url.Values{"user": {"quota-user"}, "token": {keeper}, "quota": {"100"}}, http.StatusOK},
+		{"invalid quota", "POST", url.Values{"user": {"quota-user"}, "token": {keeper}, "quota": {"-2"}}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/kurjun/rest/quota?"+c.query.Encode(), nil)
+		if c.method == "POST" {
+			r = httptest.NewRequest(c.method, "/kurjun/rest/quota", strings.NewReader(c.query.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		Quota(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s: response code %d, expected %d", c.name, w.Code, c.code)
+		}
+	}
+	if q := db.QuotaGet("quota-user"); q != 100 {
+		t.Errorf("Quota of user is %d, expected 100", q)
+	}
+}
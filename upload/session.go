@@ -0,0 +1,272 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subutai-io/agent/log"
+	"github.com/subutai-io/gorjun/config"
+	"github.com/subutai-io/gorjun/db"
+)
+
+// Chunked upload allows to send large files in several requests and to resume interrupted uploads.
+// Session is started by POST to /kurjun/rest/upload/start with file name and size, chunks are sent
+// by PUT to /kurjun/rest/upload/chunk and progress is available at /kurjun/rest/upload/status.
+// Session is finalized by regular upload request to repository with "session" value instead of file,
+// so received file passes the same processing as uploaded in one piece.
+
+type progress struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Received int64  `json:"received"`
+	Chunks   []int  `json:"chunks"`
+}
+
+// spool returns path to file where chunks of upload session are collected
+func spool(id string) string {
+	return filepath.Join(config.Storage.Tmp, "session-"+id)
+}
+
+// Start creates new upload session, reserving storage quota for the whole file
+func Start(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		token := r.Header.Get("token")
+		owner := strings.ToLower(db.CheckTokenScope(token, "upload", ""))
+		if len(token) == 0 || len(owner) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Not authorized"))
+			log.Warn(r.RemoteAddr + " - rejecting unauthorized upload request")
+			return
+		}
+		if owner = onBehalf(w, r, owner); len(owner) == 0 {
+			return
+		}
+		name := filepath.Base(r.FormValue("filename"))
+		size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+		if len(r.FormValue("filename")) == 0 || err != nil || size <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Please specify file name and size"))
+			return
+		}
+		if left := db.QuotaLeft(owner); left != -1 && size >= int64(left) {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("Storage quota exceeded"))
+			log.Warn("User " + owner + " exceeded storage quota, rejecting upload")
+			return
+		}
+
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); log.Check(log.WarnLevel, "Generating upload session id", err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to start upload session"))
+			return
+		}
+		id := hex.EncodeToString(b)
+
+		os.MkdirAll(config.Storage.Tmp, 0755)
+		f, err := os.Create(spool(id))
+		if log.Check(log.WarnLevel, "Creating upload session file", err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to start upload session"))
+			return
+		}
+		f.Close()
+
+		db.QuotaUsageSet(owner, int(size))
+		db.SaveUpload(id, owner, name, size)
+		log.Info("User " + owner + " started upload of " + name + ", quota usage +" + strconv.FormatInt(size, 10))
+		w.Write([]byte(id))
+	}
+}
+
+// Chunk writes body of request to upload session file at specified offset
+func Chunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		id, info, _ := session(w, r)
+		if len(id) == 0 {
+			return
+		}
+		if !db.TouchUpload(id) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Upload session not found"))
+			return
+		}
+		size, _ := strconv.ParseInt(info["size"], 10, 64)
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		chunk, cerr := strconv.Atoi(r.URL.Query().Get("chunk"))
+		if err != nil || cerr != nil || offset < 0 || offset >= size || chunk < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid chunk number or offset"))
+			return
+		}
+
+		f, err := os.OpenFile(spool(id), os.O_WRONLY, 0)
+		if log.Check(log.WarnLevel, "Opening upload session file", err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to write chunk"))
+			return
+		}
+		defer f.Close()
+		if _, err = f.Seek(offset, io.SeekStart); err == nil {
+			var n int64
+			n, err = io.Copy(f, io.LimitReader(r.Body, size-offset+1))
+			if err == nil && offset+n > size {
+				f.Truncate(size)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Chunk exceeds declared file size"))
+				return
+			}
+			if err == nil {
+				db.UploadChunk(id, strconv.Itoa(chunk), offset, n)
+			}
+		}
+		if log.Check(log.WarnLevel, "Writing chunk "+strconv.Itoa(chunk)+" of upload session "+id, err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to write chunk"))
+			return
+		}
+		_, chunks := db.UploadInfo(id)
+		w.Write([]byte(strconv.FormatInt(received(chunks), 10)))
+	}
+}
+
+// Status shows progress of upload session: number of contiguous bytes received from beginning and list of received chunks
+func Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		id, info, chunks := session(w, r)
+		if len(id) == 0 {
+			return
+		}
+		p := progress{ID: id, Name: info["name"], Received: received(chunks), Chunks: []int{}}
+		p.Size, _ = strconv.ParseInt(info["size"], 10, 64)
+		for k := range chunks {
+			if n, err := strconv.Atoi(k); err == nil {
+				p.Chunks = append(p.Chunks, n)
+			}
+		}
+		sort.Ints(p.Chunks)
+		js, _ := json.Marshal(p)
+		w.Write(js)
+	}
+}
+
+// session returns id and properties of upload session requested by its owner, writing error response otherwise
+func session(w http.ResponseWriter, r *http.Request) (id string, info, chunks map[string]string) {
+	token := r.Header.Get("token")
+	owner := strings.ToLower(db.CheckTokenScope(token, "upload", ""))
+	if len(token) == 0 || len(owner) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Not authorized"))
+		return "", nil, nil
+	}
+	if owner = onBehalf(w, r, owner); len(owner) == 0 {
+		return "", nil, nil
+	}
+	id = r.URL.Query().Get("id")
+	info, chunks = db.UploadInfo(id)
+	if len(id) == 0 || info["owner"] != owner {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Upload session not found"))
+		return "", nil, nil
+	}
+	return id, info, chunks
+}
+
+// received returns number of bytes received from the beginning of file without gaps
+func received(chunks map[string]string) (pos int64) {
+	var ranges [][2]int64
+	for _, v := range chunks {
+		s := strings.SplitN(v, ":", 2)
+		if len(s) != 2 {
+			continue
+		}
+		offset, err := strconv.ParseInt(s[0], 10, 64)
+		length, lerr := strconv.ParseInt(s[1], 10, 64)
+		if err == nil && lerr == nil {
+			ranges = append(ranges, [2]int64{offset, offset + length})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	for _, v := range ranges {
+		if v[0] > pos {
+			break
+		}
+		if v[1] > pos {
+			pos = v[1]
+		}
+	}
+	return pos
+}
+
+// finish moves completely received file of upload session to storage. Quota reserved on session start
+// is passed with returned sums and released by repo handler when record about file is written.
+func finish(w http.ResponseWriter, id, owner string) Sums {
+	info, chunks := db.UploadInfo(id)
+	if info["owner"] != owner {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Upload session not found"))
+		return Sums{}
+	}
+	size, _ := strconv.ParseInt(info["size"], 10, 64)
+	if received(chunks) < size {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Upload is not complete"))
+		return Sums{}
+	}
+	// Concurrent requests may finish the same session, only the one which removed it proceeds
+	if !db.DeleteUpload(id, time.Time{}) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Upload session not found"))
+		return Sums{}
+	}
+
+	h := newHasher()
+	f, err := os.Open(spool(id))
+	if err == nil {
+		_, err = io.Copy(h, f)
+		f.Close()
+	}
+	sums := h.sums(info["name"])
+	if err == nil {
+		err = keep(sums, spool(id))
+	}
+	if log.Check(log.WarnLevel, "Moving "+info["name"]+" to storage", err) {
+		db.QuotaUsageSet(owner, -int(size))
+		os.Remove(spool(id))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to save file"))
+		return Sums{}
+	}
+	log.Info("File received: " + sums.Name + "(" + sums.Md5 + ")")
+	sums.reserved = size
+	return sums
+}
+
+// Expire periodically removes upload sessions which were inactive longer than configured lifetime, releasing reserved quota
+func Expire() {
+	for {
+		deadline := time.Now().Add(-config.UploadTTL())
+		for _, id := range db.Uploads(deadline) {
+			info, _ := db.UploadInfo(id)
+			size, _ := strconv.ParseInt(info["size"], 10, 64)
+			// Session is kept if it became active again after listing
+			if !db.DeleteUpload(id, deadline) {
+				continue
+			}
+			os.Remove(spool(id))
+			db.QuotaUsageSet(info["owner"], -int(size))
+			log.Info("Upload session " + id + " of " + info["owner"] + " expired, quota usage -" + strconv.FormatInt(size, 10))
+		}
+		time.Sleep(10 * time.Minute)
+	}
+}
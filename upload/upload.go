@@ -7,7 +7,10 @@ import (
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
@@ -16,6 +19,7 @@ import (
 	"github.com/subutai-io/agent/log"
 	"github.com/subutai-io/gorjun/config"
 	"github.com/subutai-io/gorjun/db"
+	"github.com/subutai-io/gorjun/storage"
 )
 
 type share struct {
@@ -26,10 +30,58 @@ type share struct {
 	Repo   string   `json:"repo"`
 }
 
+// Sums keeps hash sums and size of received file, and size of quota reserved for it until record is written
+type Sums struct {
+	Md5    string
+	Sha1   string
+	Sha256 string
+	Sha512 string
+	Size   int64
+	Name   string
+
+	reserved int64
+}
+
+// hasher calculates all hash sums of data written to it in a single pass
+type hasher struct {
+	md5, sha1, sha256, sha512 hash.Hash
+	size                      int64
+}
+
+func newHasher() *hasher {
+	return &hasher{md5: md5.New(), sha1: sha1.New(), sha256: sha256.New(), sha512: sha512.New()}
+}
+
+func (h *hasher) Write(p []byte) (int, error) {
+	for _, v := range []hash.Hash{h.md5, h.sha1, h.sha256, h.sha512} {
+		v.Write(p)
+	}
+	h.size += int64(len(p))
+	return len(p), nil
+}
+
+func (h *hasher) sums(name string) Sums {
+	return Sums{
+		Md5:    fmt.Sprintf("%x", h.md5.Sum(nil)),
+		Sha1:   fmt.Sprintf("%x", h.sha1.Sum(nil)),
+		Sha256: fmt.Sprintf("%x", h.sha256.Sum(nil)),
+		Sha512: fmt.Sprintf("%x", h.sha512.Sum(nil)),
+		Size:   h.size,
+		Name:   name,
+	}
+}
+
 //Handler function works with income upload requests, makes sanity checks, etc
-func Handler(w http.ResponseWriter, r *http.Request) (md5sum, sha256sum, owner string) {
+func Handler(w http.ResponseWriter, r *http.Request) (sums Sums, owner string) {
 	token := r.Header.Get("token")
-	owner = strings.ToLower(db.CheckToken(token))
+	owner = strings.ToLower(db.CheckTokenScope(token, "upload", repository(r)))
+	// Deploy key may be used instead of token, its name patterns are checked when file name is known
+	key := db.DeployKey(token)
+	if len(owner) == 0 && allows(key, repository(r), "") {
+		owner = strings.ToLower(key["owner"])
+	} else {
+		key = nil
+	}
 	if len(token) == 0 || len(owner) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Not authorized"))
@@ -37,6 +89,19 @@ func Handler(w http.ResponseWriter, r *http.Request) (md5sum, sha256sum, owner s
 		return
 	}
 	r.ParseMultipartForm(32 << 20)
+	if owner = onBehalf(w, r, owner); len(owner) == 0 {
+		return
+	}
+
+	if id := r.FormValue("session"); len(id) != 0 {
+		if info, _ := db.UploadInfo(id); denied(w, r, key, info["name"]) {
+			return Sums{}, owner
+		}
+		if key != nil {
+			db.DeployKeyUsed(token)
+		}
+		return finish(w, id, owner), owner
+	}
 
 	file, header, err := r.FormFile("file")
 	if log.Check(log.WarnLevel, "Failed to parse POST form", err) {
@@ -46,59 +111,134 @@ func Handler(w http.ResponseWriter, r *http.Request) (md5sum, sha256sum, owner s
 	}
 	defer file.Close()
 
-	if !сheckLength(owner, r.Header.Get("Content-Length")) {
+	if denied(w, r, key, header.Filename) {
+		return Sums{}, owner
+	}
+	if key != nil {
+		db.DeployKeyUsed(token)
+	}
+
+	if !db.ReserveQuota(owner, header.Size) {
 		w.WriteHeader(http.StatusNotAcceptable)
 		w.Write([]byte("Storage quota exceeded"))
 		log.Warn("User " + owner + " exceeded storage quota, rejecting upload")
 		return
 	}
 
-	out, err := os.Create(config.Storage.Path + header.Filename)
-	if log.Check(log.WarnLevel, "Unable to create the file for writing", err) {
+	sums, err = save(owner, file, header.Filename)
+	if err != nil {
+		db.QuotaUsageSet(owner, -int(header.Size))
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Cannot create file"))
-		return
+		w.Write([]byte(err.Error()))
+		return Sums{}, owner
 	}
-	defer out.Close()
+	sums.reserved = header.Size
+	return sums, owner
+}
 
-	limit := int64(db.QuotaLeft(owner))
-	f := io.Reader(file)
-	if limit != -1 {
-		f = io.LimitReader(file, limit)
+// Release frees storage quota reserved for received file. Repo handlers call it when record about file is written,
+// which charges quota for stored file, or when file is rejected.
+func Release(owner string, sums Sums) {
+	if sums.reserved > 0 {
+		db.QuotaUsageSet(owner, -int(sums.reserved))
 	}
+}
 
-	// write the content from POST to the file
-	if copied, err := io.Copy(out, f); limit != -1 && (copied == limit || err != nil) {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to write file or storage quota exceeded"))
-		log.Warn("User " + owner + " exceeded storage quota, removing file")
-		os.Remove(config.Storage.Path + header.Filename)
-		return
-	} else {
-		db.QuotaUsageSet(owner, int(copied))
-		log.Info("User " + owner + ", quota usage +" + strconv.Itoa(int(copied)))
+// repository returns name of repo which request is addressed to, e.g. "raw" for /kurjun/rest/raw/upload
+func repository(r *http.Request) string {
+	if path := strings.Split(r.URL.EscapedPath(), "/"); len(path) > 3 {
+		return path[3]
 	}
+	return ""
+}
 
-	md5sum = Hash(config.Storage.Path + header.Filename)
-	sha256sum = Hash(config.Storage.Path+header.Filename, "sha256")
-	if len(md5sum) == 0 || len(sha256sum) == 0 {
-		log.Warn("Failed to calculate hash for " + header.Filename)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to calculate hash"))
-		return
+// Store saves additional file of multipart request on behalf of owner, e.g. source tarballs of apt source package.
+// Caller is responsible for writing record about file to DB and releasing reserved quota.
+func Store(owner string, header *multipart.FileHeader) (Sums, error) {
+	file, err := header.Open()
+	if err != nil {
+		return Sums{}, err
+	}
+	defer file.Close()
+
+	if !db.ReserveQuota(owner, header.Size) {
+		log.Warn("User " + owner + " exceeded storage quota, rejecting upload")
+		return Sums{}, fmt.Errorf("Storage quota exceeded")
+	}
+	sums, err := save(owner, file, header.Filename)
+	if err != nil {
+		db.QuotaUsageSet(owner, -int(header.Size))
+		return Sums{}, err
 	}
+	sums.reserved = header.Size
+	return sums, nil
+}
+
+// save writes file to storage under its md5 hash. Quota for the file is reserved by caller, as size
+// of multipart file is known in advance. File is received to temporary directory first, as its hash
+// is not known in advance. All hash sums are calculated while receiving, so file is never read again.
+func save(owner string, file io.Reader, filename string) (Sums, error) {
+	os.MkdirAll(config.Storage.Tmp, 0755)
+	out, err := ioutil.TempFile(config.Storage.Tmp, "upload-")
+	if log.Check(log.WarnLevel, "Unable to create the file for writing", err) {
+		return Sums{}, fmt.Errorf("Cannot create file")
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	h := newHasher()
+
+	// write the content from POST to the file, calculating hash sums on the fly
+	if _, err := io.Copy(io.MultiWriter(out, h), file); err != nil {
+		log.Warn("Receiving file of " + owner + " failed, removing file")
+		return Sums{}, fmt.Errorf("Failed to write file")
+	}
+	sums := h.sums(filename)
+
+	out.Close()
+	if log.Check(log.WarnLevel, "Moving "+filename+" to storage", keep(sums, out.Name())) {
+		return Sums{}, fmt.Errorf("Failed to save file")
+	}
+	log.Info("File received: " + filename + "(" + sums.Md5 + ")")
 
-	os.Rename(config.Storage.Path+header.Filename, config.Storage.Path+md5sum)
-	log.Info("File received: " + header.Filename + "(" + md5sum + ")")
+	return sums, nil
+}
 
-	return md5sum, sha256sum, owner
+// keep moves received file to storage unless the same content is already stored. Quota is charged
+// when the record referencing stored blob is written to DB, files without records are removed by db.DropBlob.
+// Blob is pinned in DB until then, so it is not removed by concurrent uploads or deletions of the same content.
+func keep(sums Sums, path string) error {
+	if key := db.PinBlob(sums.Sha256); len(key) != 0 {
+		if storage.Size(key) == sums.Size {
+			os.Remove(path)
+			log.Info("File " + sums.Name + " is already stored as " + key)
+			return nil
+		}
+		// Stored copy is missing or damaged, it is replaced with received one
+		if err := storage.Import(key, path); err != nil {
+			db.DropBlob(sums.Sha256)
+			return err
+		}
+		return nil
+	}
+	if err := storage.Import(sums.Md5, path); err != nil {
+		return err
+	}
+	db.AddBlob(sums.Sha256, sums.Md5, sums.Size)
+	return nil
 }
 
-func Hash(file string, algo ...string) string {
-	f, err := os.Open(file)
-	log.Check(log.WarnLevel, "Opening file "+file, err)
+// Hash returns hash sum of stored file. Default algorithm is md5, sha1, sha256 and sha512 may be requested.
+func Hash(key string, algo ...string) string {
+	f, err := storage.Get(key)
+	if log.Check(log.WarnLevel, "Opening file "+key, err) {
+		return ""
+	}
 	defer f.Close()
+	return checksum(f, algo...)
+}
 
+func checksum(f io.Reader, algo ...string) string {
 	hash := md5.New()
 	if len(algo) != 0 {
 		switch algo[0] {
@@ -125,7 +265,13 @@ func Delete(w http.ResponseWriter, r *http.Request) string {
 		log.Warn(r.RemoteAddr + " - empty file id")
 		return ""
 	}
-	user := db.CheckToken(token)
+	user := db.CheckTokenScope(token, "delete", repository(r))
+	key := db.DeployKey(token)
+	if len(user) == 0 && allows(key, repository(r), "") {
+		user = strings.ToLower(key["owner"])
+	} else {
+		key = nil
+	}
 	if len(token) == 0 || len(user) == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Failed to authorize using provided token"))
@@ -139,6 +285,9 @@ func Delete(w http.ResponseWriter, r *http.Request) string {
 		w.Write([]byte("File not found"))
 		return ""
 	}
+	if denied(w, r, key, info["name"]) {
+		return ""
+	}
 
 	repo := strings.Split(r.URL.EscapedPath(), "/")
 	if len(repo) < 4 {
@@ -148,28 +297,20 @@ func Delete(w http.ResponseWriter, r *http.Request) string {
 		return ""
 	}
 
-	if db.CheckRepo(user, repo[3], id) == 0 {
+	// Maintainers may remove artifacts of their organizations
+	owner := db.ActingOwner(user, repo[3], id)
+	if len(owner) == 0 {
 		log.Warn("File " + info["name"] + "(" + id + ") in " + repo[3] + " repo is not owned by " + user + ", rejecting deletion request")
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("File " + info["name"] + " not found or it has different owner"))
 		return ""
 	}
-	md5, _ := db.Hash(id)
-	f, err := os.Stat(config.Storage.Path + md5)
-	if !log.Check(log.WarnLevel, "Reading file stats", err) {
-		db.QuotaUsageSet(user, -int(f.Size()))
-		log.Info("User " + user + ", quota usage -" + strconv.Itoa(int(f.Size())))
-	}
-
-	if db.Delete(user, repo[3], id) == 0 {
-		log.Warn("Removing " + id + " from disk")
-		// torrent.Delete(id)
-		if log.Check(log.WarnLevel, "Removing "+info["name"]+"from disk", os.Remove(config.Storage.Path+md5)) {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Failed to remove file"))
-			return ""
-		}
+	if key != nil {
+		db.DeployKeyUsed(token)
 	}
+	// File is removed from storage and quota usage is updated by db when the last reference is gone
+	db.Delete(owner, repo[3], id)
+	// torrent.Delete(id)
 
 	log.Info("Removing " + info["name"] + " from " + repo[3] + " repo")
 	return id
@@ -189,7 +330,7 @@ func Share(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Failed to parse json body"))
 			return
 		}
-		if len(data.Token) == 0 || len(db.CheckToken(data.Token)) == 0 {
+		if len(data.Token) == 0 || len(db.CheckTokenScope(data.Token, "share", data.Repo)) == 0 {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Not authorized"))
 			log.Warn("Empty or invalid token, rejecting share request")
@@ -207,8 +348,8 @@ func Share(w http.ResponseWriter, r *http.Request) {
 			log.Warn("Empty repo name, rejecting share request")
 			return
 		}
-		owner := strings.ToLower(db.CheckToken(data.Token))
-		if db.CheckRepo(owner, data.Repo, data.Id) == 0 {
+		owner := db.ActingOwner(strings.ToLower(db.CheckTokenScope(data.Token, "share", data.Repo)), data.Repo, data.Id)
+		if len(owner) == 0 {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("File is not owned by authorized user"))
 			log.Warn("User tried to share another's file, rejecting")
@@ -230,46 +371,44 @@ func Share(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		token := r.URL.Query().Get("token")
-		if len(token) == 0 || len(db.CheckToken(token)) == 0 {
+		repo := r.URL.Query().Get("repo")
+		if len(token) == 0 || len(db.CheckTokenScope(token, "share", repo)) == 0 {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Not authorized"))
 			return
 		}
-		owner := db.CheckToken(token)
-		repo := r.URL.Query().Get("repo")
+		owner := db.CheckTokenScope(token, "share", repo)
 		if len(repo) == 0 {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Repository not specified"))
 			return
 		}
-		if db.CheckRepo(owner, repo, id) == 0 {
+		if owner = db.ActingOwner(strings.ToLower(owner), repo, id); len(owner) == 0 {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("File is not owned by authorized user"))
 			log.Warn("User tried to request scope of another's file, rejecting")
 			return
 		}
-		js, _ := json.Marshal(db.GetScope(id, strings.ToLower(owner)))
+		js, _ := json.Marshal(db.GetScope(id, owner))
 		w.Write(js)
 	}
 }
 
-func сheckLength(user, length string) bool {
-	l, err := strconv.Atoi(length)
-	if err != nil || len(length) == 0 || l < db.QuotaLeft(user) || db.QuotaLeft(user) == -1 {
-		return true
-	}
-	return false
-}
-
 func Quota(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		user := r.URL.Query().Get("user")
 		fix := r.URL.Query().Get("fix")
 		token := r.URL.Query().Get("token")
 
-		if len(token) == 0 || len(db.CheckToken(token)) == 0 || db.CheckToken(token) != "Hub" && !strings.EqualFold(db.CheckToken(token), user) {
+		if name := db.CheckTokenScope(token, "read", ""); len(token) == 0 || len(name) == 0 || !db.Allowed(name, "quota") && !strings.EqualFold(name, user) {
+			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("Forbidden"))
+			return
+		}
+		// Recalculation of usage affects all users, so it is reserved for quota managers
+		if len(fix) != 0 && !db.Allowed(db.CheckTokenScope(token, "admin", ""), "quota") {
 			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden"))
 			return
 		}
 
@@ -281,7 +420,7 @@ func Quota(w http.ResponseWriter, r *http.Request) {
 				"left":  db.QuotaLeft(user)})
 			w.Write([]byte(q))
 		}
-		if user == "subutai" && len(fix) != 0 {
+		if len(fix) != 0 {
 			db.QuotaUsageCorrect()
 		}
 
@@ -290,27 +429,26 @@ func Quota(w http.ResponseWriter, r *http.Request) {
 		quota := r.FormValue("quota")
 		token := r.FormValue("token")
 
-		if len(token) == 0 || len(db.CheckToken(token)) == 0 || db.CheckToken(token) != "Hub" && db.CheckToken(token) != "subutai" {
-			w.Write([]byte("Forbidden"))
+		if name := db.CheckTokenScope(token, "admin", ""); len(token) == 0 || !db.Allowed(name, "quota") {
 			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden"))
 			return
 		}
 
 		if len(user) == 0 || len(quota) == 0 {
-			w.Write([]byte("Please specify username and quota value"))
 			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Please specify username and quota value"))
 			return
 		}
 
 		if q, err := strconv.Atoi(quota); err != nil || q < -1 {
-			w.Write([]byte("Invalid quota value"))
 			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid quota value"))
 			return
 		}
 
 		db.QuotaSet(user, quota)
 		log.Info("New quota for " + user + " is " + quota)
 		w.Write([]byte("Ok"))
-		w.WriteHeader(http.StatusOK)
 	}
 }